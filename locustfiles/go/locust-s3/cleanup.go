@@ -0,0 +1,349 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// max number of keys of a multi-object delete request
+const maxDeleteKeys = 1000
+
+// cleanupSummary counts what cleanup did
+type cleanupSummary struct {
+	deleted int64
+	failed  int64
+	aborted int64
+	buckets int64
+	kept    int64
+}
+
+// cleaner deletes objects given to it with multi-object delete requests
+type cleaner struct {
+	catalog      objfactory.Catalog
+	bypass       bool
+	summary      cleanupSummary
+	mutex        sync.Mutex
+	failedClaims []*objfactory.ObjectSpec
+	// bucket/key of read-only objects of the catalog, which listing by prefix leaves alone
+	readOnly map[string]bool
+}
+
+// cleanup deletes all objects written by a run, either drained from the object catalog
+// or listed by object_prefix in every bucket
+func cleanup(args []string) {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	source := fs.String("source", "", "where objects come from, catalog or prefix. "+
+		"default to catalog if a redis or disk cache is enabled, otherwise prefix")
+	workers := fs.Int("workers", 8, "number of concurrent delete requests")
+	allVersions := fs.Bool("all-versions", config.LoadConf.Data.ObjectLock.Enabled,
+		"with prefix source, delete all versions and delete markers instead of the current objects")
+	bypass := fs.Bool("bypass-governance", false, "bypass governance retention of locked objects")
+	removeBuckets := fs.Bool("remove-buckets", false, "remove buckets after objects are deleted, "+
+		"only the ones created by create_bucket_on_start of the run")
+	force := fs.Bool("force", false, "list by an empty object_prefix, which is every object of the buckets")
+	fs.Parse(args)
+
+	if *source == "" {
+		*source = "prefix"
+		if config.LoadConf.Data.CacheResult && config.LoadConf.Cache.Type != config.CacheMemory {
+			*source = "catalog"
+		}
+	}
+	if *workers <= 0 {
+		log.Fatalf("invalid number of workers %d", *workers)
+	}
+	prefixErr := checkCleanupPrefix(*force)
+	if *source == "prefix" && prefixErr != nil {
+		log.Fatalf("could not clean up by prefix, %s", prefixErr.Error())
+	}
+	var created objfactory.BucketCatalog
+	if *removeBuckets {
+		// buckets which existed before, even owned by us, are not known to the run
+		var ok bool
+		if config.LoadConf.Data.CacheResult && config.LoadConf.Cache.Type != config.CacheMemory {
+			created, ok = mustCatalog().(objfactory.BucketCatalog)
+		}
+		if !ok {
+			log.Fatalln("buckets created by the run are only recorded in a redis or disk cache, they are not removed")
+		}
+	}
+
+	sharedServiceClient = initS3Client()
+	c := &cleaner{bypass: *bypass}
+	objects := make(chan *objfactory.ObjectSpec, maxDeleteKeys)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.work(objects)
+		}()
+	}
+
+	switch *source {
+	case "catalog":
+		c.catalog = mustCatalog()
+		c.drainCatalog(objects)
+	case "prefix":
+		if config.LoadConf.Data.CacheResult && config.LoadConf.Cache.Type != config.CacheMemory {
+			c.readOnly = readOnlyObjects(mustCatalog())
+		}
+		for _, b := range config.LoadConf.Data.Buckets {
+			c.listPrefix(b, *allVersions, objects)
+		}
+	default:
+		log.Fatalf("unsupported source %s, should be catalog or prefix", *source)
+	}
+	close(objects)
+	wg.Wait()
+
+	// objects failed to delete were claimed, put them back so they could be retried
+	for _, o := range c.failedClaims {
+		if err := c.catalog.Release(o); err != nil {
+			fmt.Printf("failed to release %s/%s in catalog with %s\n", o.ObjectBucket, o.ObjectKey, err.Error())
+		}
+	}
+
+	if prefixErr != nil {
+		fmt.Printf("multipart uploads are not aborted, %s\n", prefixErr.Error())
+	} else {
+		for _, b := range config.LoadConf.Data.Buckets {
+			c.abortUploads(b)
+		}
+	}
+	if created != nil {
+		c.removeBuckets(created)
+	}
+	fmt.Printf("deleted %d objects, %d failed, kept %d read-only objects, aborted %d multipart uploads, removed %d buckets\n",
+		c.summary.deleted, c.summary.failed, c.summary.kept, c.summary.aborted, c.summary.buckets)
+}
+
+// removeBuckets removes buckets recorded as created by the run
+func (c *cleaner) removeBuckets(created objfactory.BucketCatalog) {
+	buckets, err := created.Buckets()
+	if err != nil {
+		log.Fatalf("failed to read buckets of catalog with %s", err.Error())
+	}
+	for _, b := range buckets {
+		if _, err := sharedServiceClient.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(b)}); err != nil {
+			fmt.Printf("failed to remove bucket %s with %s\n", b, err.Error())
+			continue
+		}
+		c.summary.buckets++
+		if err := created.RemoveBucket(b); err != nil {
+			fmt.Printf("failed to forget bucket %s in catalog with %s\n", b, err.Error())
+		}
+	}
+}
+
+// checkCleanupPrefix tells why listing by object_prefix would not find exactly the objects
+// of runs, or nil if it does
+func checkCleanupPrefix(force bool) error {
+	if !strings.HasPrefix(config.LoadConf.Data.Key.Template, "{prefix}") {
+		return fmt.Errorf("key template %s does not start with {prefix}", config.LoadConf.Data.Key.Template)
+	}
+	if config.LoadConf.Data.ObjectPrefix == "" && !force {
+		return errors.New("object_prefix is empty, which is every object of the buckets, give -force to do it anyway")
+	}
+	return nil
+}
+
+// drainCatalog claims objects of the catalog until it is empty. objects claimed by runners,
+// even ones which died, are taken over no matter their lease, since the run is torn down.
+func (c *cleaner) drainCatalog(objects chan<- *objfactory.ObjectSpec) {
+	if err := c.catalog.ReleaseAll(); err != nil {
+		log.Fatalf("failed to take over claimed objects of catalog with %s", err.Error())
+	}
+	for {
+		var o objfactory.ObjectSpec
+		err := c.catalog.Claim(&o)
+		if err == objfactory.ErrEmptyCatalog {
+			return
+		}
+		if err != nil {
+			log.Fatalf("failed to read catalog with %s", err.Error())
+		}
+		objects <- &o
+	}
+}
+
+// readOnlyObjects returns bucket/key of read-only objects of the catalog, e.g. imported ones
+func readOnlyObjects(catalog objfactory.Catalog) map[string]bool {
+	readOnly := make(map[string]bool)
+	err := catalog.ForEach(func(o *objfactory.ObjectSpec) error {
+		if o.ReadOnly {
+			readOnly[o.ObjectBucket+"/"+o.ObjectKey] = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("failed to read catalog with %s", err.Error())
+	}
+	return readOnly
+}
+
+// listPrefix lists objects under object_prefix of a bucket. read-only objects of the catalog
+// are not deleted.
+func (c *cleaner) listPrefix(bucket string, allVersions bool, objects chan<- *objfactory.ObjectSpec) {
+	prefix := aws.String(config.LoadConf.Data.ObjectPrefix)
+	send := func(o *objfactory.ObjectSpec) {
+		if c.readOnly[bucket+"/"+o.ObjectKey] {
+			atomic.AddInt64(&c.summary.kept, 1)
+			return
+		}
+		objects <- o
+	}
+	var err error
+	if allVersions {
+		err = sharedServiceClient.ListObjectVersionsPages(&s3.ListObjectVersionsInput{Bucket: aws.String(bucket), Prefix: prefix},
+			func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+				for _, v := range page.Versions {
+					send(&objfactory.ObjectSpec{ObjectBucket: bucket, ObjectKey: aws.StringValue(v.Key),
+						VersionID: aws.StringValue(v.VersionId)})
+				}
+				for _, m := range page.DeleteMarkers {
+					send(&objfactory.ObjectSpec{ObjectBucket: bucket, ObjectKey: aws.StringValue(m.Key),
+						VersionID: aws.StringValue(m.VersionId)})
+				}
+				return true
+			})
+	} else {
+		err = sharedServiceClient.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: prefix},
+			func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+				for _, o := range page.Contents {
+					send(&objfactory.ObjectSpec{ObjectBucket: bucket, ObjectKey: aws.StringValue(o.Key)})
+				}
+				return true
+			})
+	}
+	if err != nil {
+		fmt.Printf("failed to list bucket %s with %s\n", bucket, err.Error())
+	}
+}
+
+// work deletes objects in batches of the same bucket
+func (c *cleaner) work(objects <-chan *objfactory.ObjectSpec) {
+	batches := make(map[string][]*objfactory.ObjectSpec)
+	for o := range objects {
+		batch := append(batches[o.ObjectBucket], o)
+		if len(batch) == maxDeleteKeys {
+			c.delete(o.ObjectBucket, batch)
+			batch = nil
+		}
+		batches[o.ObjectBucket] = batch
+	}
+	for bucket, batch := range batches {
+		if len(batch) > 0 {
+			c.delete(bucket, batch)
+		}
+	}
+}
+
+// delete removes a batch of objects of a bucket with one request
+func (c *cleaner) delete(bucket string, batch []*objfactory.ObjectSpec) {
+	ids := make([]*s3.ObjectIdentifier, len(batch))
+	for i, o := range batch {
+		ids[i] = &s3.ObjectIdentifier{Key: aws.String(o.ObjectKey)}
+		if o.VersionID != "" {
+			ids[i].VersionId = aws.String(o.VersionID)
+		}
+	}
+	input := &s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &s3.Delete{Objects: ids, Quiet: aws.Bool(true)},
+	}
+	if c.bypass {
+		input.BypassGovernanceRetention = aws.Bool(true)
+	}
+	resp, err := sharedServiceClient.DeleteObjects(input)
+	// keyed by key and version, as all versions of a key may be in one batch
+	failed := make(map[string]bool)
+	if err != nil {
+		fmt.Printf("failed to delete %d objects of bucket %s with %s\n", len(batch), bucket, err.Error())
+		for _, o := range batch {
+			failed[o.ObjectKey+"\x00"+o.VersionID] = true
+		}
+	} else {
+		for _, e := range resp.Errors {
+			if config.Verbose {
+				fmt.Printf("failed to delete %s/%s with %s\n", bucket, aws.StringValue(e.Key), aws.StringValue(e.Message))
+			}
+			failed[aws.StringValue(e.Key)+"\x00"+aws.StringValue(e.VersionId)] = true
+		}
+	}
+
+	for _, o := range batch {
+		if failed[o.ObjectKey+"\x00"+o.VersionID] {
+			atomic.AddInt64(&c.summary.failed, 1)
+			if c.catalog != nil {
+				c.mutex.Lock()
+				c.failedClaims = append(c.failedClaims, o)
+				c.mutex.Unlock()
+			}
+			continue
+		}
+		atomic.AddInt64(&c.summary.deleted, 1)
+		if c.catalog != nil {
+			if err := c.catalog.Confirm(o); err != nil {
+				fmt.Printf("failed to remove %s/%s from catalog with %s\n", bucket, o.ObjectKey, err.Error())
+			}
+		}
+	}
+}
+
+// abortUploads aborts multipart uploads under object_prefix of a bucket
+func (c *cleaner) abortUploads(bucket string) {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(config.LoadConf.Data.ObjectPrefix),
+	}
+	var uploads []*s3.MultipartUpload
+	err := sharedServiceClient.ListMultipartUploadsPages(input, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		uploads = append(uploads, page.Uploads...)
+		return true
+	})
+	if err != nil {
+		fmt.Printf("failed to list multipart uploads of bucket %s with %s\n", bucket, err.Error())
+		return
+	}
+	for _, u := range uploads {
+		_, err := sharedServiceClient.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      u.Key,
+			UploadId: u.UploadId,
+		})
+		if err != nil {
+			fmt.Printf("failed to abort upload %s of %s/%s with %s\n",
+				aws.StringValue(u.UploadId), bucket, aws.StringValue(u.Key), err.Error())
+			continue
+		}
+		c.summary.aborted++
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+)
+
+// commands could be given as the first argument to run a one-off job instead of
+// connecting to locust master. each command parses its own flags.
+var commands = map[string]func(args []string){
+	"export":  exportCatalog,
+	"runs":    manageRuns,
+	"cleanup": cleanup,
+	"prepare": prepare,
+	"import":  importObjects,
+	"sizes":   sampleSizes,
+}
+
+// runCommand runs the command named by the first argument. it returns false if there is none.
+func runCommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		return false
+	}
+	cmd(os.Args[2:])
+	return true
+}
+
+// mustCatalog returns the configured object catalog or exits
+func mustCatalog() objfactory.Catalog {
+	catalog := objfactory.ObjectCatalog()
+	if catalog == nil {
+		log.Fatalln("no cache enabled, please enable cache_result")
+	}
+	return catalog
+}
+
+// exportedObject is one line of the exported catalog
+type exportedObject struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	VersionID string `json:"version_id,omitempty"`
+}
+
+// exportCatalog writes every object of the catalog as a json line, e.g. for later cleanup
+func exportCatalog(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("output", "", "file to write to, default to stdout")
+	fs.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("failed to create %s with %s", *output, err.Error())
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var count int
+	err := mustCatalog().ForEach(func(o *objfactory.ObjectSpec) error {
+		count++
+		return enc.Encode(exportedObject{o.ObjectBucket, o.ObjectKey, o.ObjectSize, o.VersionID})
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Fatalf("failed to export catalog with %s", err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "exported %d objects\n", count)
+}
+
+// manageRuns lists runs in the catalog, shows one of them or drops its catalog
+func manageRuns(args []string) {
+	usage := "usage: runs list | show <run_id> | drop <run_id>"
+	if len(args) == 0 {
+		log.Fatalln(usage)
+	}
+	runs, ok := mustCatalog().(objfactory.RunCatalog)
+	if !ok {
+		log.Fatalln("runs are not supported by memory cache")
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		infos, err := runs.Runs()
+		if err != nil {
+			log.Fatalf("failed to list runs with %s", err.Error())
+		}
+		for _, info := range infos {
+			fmt.Printf("%s\t%d objects\t%d bytes\n", info.ID, info.Objects, info.Bytes)
+		}
+	case args[0] == "show" && len(args) == 2:
+		infos, err := runs.Runs()
+		if err != nil {
+			log.Fatalf("failed to list runs with %s", err.Error())
+		}
+		for _, info := range infos {
+			if info.ID == args[1] {
+				fmt.Printf("run %s\nobjects %d\nbytes %d\n", info.ID, info.Objects, info.Bytes)
+				return
+			}
+		}
+		log.Fatalf("run %s not found", args[1])
+	case args[0] == "drop" && len(args) == 2:
+		if err := runs.DropRun(args[1]); err != nil {
+			log.Fatalf("failed to drop run %s with %s", args[1], err.Error())
+		}
+		fmt.Fprintf(os.Stderr, "dropped catalog of run %s\n", args[1])
+	default:
+		log.Fatalln(usage)
+	}
+}
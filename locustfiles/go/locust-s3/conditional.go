@@ -0,0 +1,260 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/randstr"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/myzhan/boomer"
+)
+
+// requests whose response does not match the expected behavior are reported
+// with this request type, so they are not mixed with generic errors
+const correctnessRequestType = "correctness"
+
+// saveObjectInfo keeps version, ETag and Last-Modified of an uploaded object for later requests.
+// PUT does not return Last-Modified, the Date of the response is used instead.
+func saveObjectInfo(obj *objfactory.ObjectSpec, req *request.Request, out *s3.PutObjectOutput) {
+	obj.VersionID = aws.StringValue(out.VersionId)
+	// consistency checks compare ETag of later reads with the one of the upload
+	if !config.LoadConf.Data.CacheETag && !config.LoadConf.Data.Consistency.Enabled {
+		return
+	}
+	obj.ETag = aws.StringValue(out.ETag)
+	obj.LastModified = time.Now()
+	if req.HTTPResponse != nil {
+		if t, err := http.ParseTime(req.HTTPResponse.Header.Get("Date")); err == nil {
+			obj.LastModified = t
+		}
+	}
+}
+
+// statusCode returns the HTTP status of a finished request, or 0 if the request
+// failed without a response
+func statusCode(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode()
+	}
+	return 0
+}
+
+// status a conditional request could legitimately return
+var conditionalStatus = []int{http.StatusOK, http.StatusNotModified, http.StatusPreconditionFailed}
+
+// recordExpectedStatus reports a request with an expected status. a response with another
+// status in outcomes is a correctness failure, anything else is a generic error.
+func recordExpectedStatus(name string, obj *objfactory.ObjectSpec, expected int, outcomes []int,
+	elapsed int64, length int64, err error) {
+	status := statusCode(err)
+	if status == expected {
+		boomer.RecordSuccess("s3", name, elapsed, length)
+		return
+	}
+	for _, s := range outcomes {
+		if status == s {
+			boomer.RecordFailure(correctnessRequestType, name, elapsed,
+				fmt.Sprintf("%s/%s expect status %d but got %d", obj.ObjectBucket, obj.ObjectKey, expected, status))
+			return
+		}
+	}
+	boomer.RecordFailure("s3", name, elapsed, err.Error())
+}
+
+// preconditions hold the conditional headers shared by GET and HEAD
+type preconditions struct {
+	ifMatch           *string
+	ifNoneMatch       *string
+	ifModifiedSince   *time.Time
+	ifUnmodifiedSince *time.Time
+}
+
+// conditionalCase is a precondition with the status it should lead to
+type conditionalCase struct {
+	name     string
+	expected int
+	build    func(obj *objfactory.ObjectSpec) preconditions
+}
+
+// a tag that never matches any object
+func staleETag() *string {
+	return aws.String(fmt.Sprintf("\"%s\"", randstr.RandStringBytesMaskImprSrc(32)))
+}
+
+func earlier(t time.Time) *time.Time {
+	return aws.Time(t.Add(-time.Hour))
+}
+
+var conditionalCases = []conditionalCase{
+	{"ifMatch", http.StatusOK, func(obj *objfactory.ObjectSpec) preconditions {
+		return preconditions{ifMatch: aws.String(obj.ETag)}
+	}},
+	{"ifMatchStale", http.StatusPreconditionFailed, func(obj *objfactory.ObjectSpec) preconditions {
+		return preconditions{ifMatch: staleETag()}
+	}},
+	{"ifNoneMatch", http.StatusNotModified, func(obj *objfactory.ObjectSpec) preconditions {
+		return preconditions{ifNoneMatch: aws.String(obj.ETag)}
+	}},
+	{"ifNoneMatchStale", http.StatusOK, func(obj *objfactory.ObjectSpec) preconditions {
+		return preconditions{ifNoneMatch: staleETag()}
+	}},
+	{"ifModifiedSince", http.StatusNotModified, func(obj *objfactory.ObjectSpec) preconditions {
+		return preconditions{ifModifiedSince: aws.Time(obj.LastModified)}
+	}},
+	{"ifModifiedSinceEarlier", http.StatusOK, func(obj *objfactory.ObjectSpec) preconditions {
+		return preconditions{ifModifiedSince: earlier(obj.LastModified)}
+	}},
+	{"ifUnmodifiedSince", http.StatusOK, func(obj *objfactory.ObjectSpec) preconditions {
+		return preconditions{ifUnmodifiedSince: aws.Time(obj.LastModified)}
+	}},
+	{"ifUnmodifiedSinceEarlier", http.StatusPreconditionFailed, func(obj *objfactory.ObjectSpec) preconditions {
+		return preconditions{ifUnmodifiedSince: earlier(obj.LastModified)}
+	}},
+}
+
+// pickConditionalObject picks a cached object which has ETag and Last-Modified
+func pickConditionalObject(obj *objfactory.ObjectSpec, op string) bool {
+	if err := obj.GetObject(objfactory.Read); err != nil || obj.ETag == "" {
+		if config.Verbose {
+			fmt.Printf("no object with ETag for %s operation from cache, will sleep 1sec and retry\n", op)
+		}
+		time.Sleep(1000 * time.Millisecond)
+		return false
+	}
+	return true
+}
+
+func conditionalGetObject() {
+	var obj objfactory.ObjectSpec
+	if !pickConditionalObject(&obj, "conditional get") {
+		return
+	}
+	c := conditionalCases[rand.Intn(len(conditionalCases))]
+	name := fmt.Sprintf("conditionalGetObject-%s", c.name)
+	p := c.build(&obj)
+	input := &s3.GetObjectInput{
+		Bucket:            aws.String(obj.ObjectBucket),
+		Key:               aws.String(obj.ObjectKey),
+		IfMatch:           p.ifMatch,
+		IfNoneMatch:       p.ifNoneMatch,
+		IfModifiedSince:   p.ifModifiedSince,
+		IfUnmodifiedSince: p.ifUnmodifiedSince,
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(&obj)
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	resp, err := sharedServiceClient.GetObject(input)
+	var length int64
+	if err == nil {
+		length, err = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	recordExpectedStatus(name, &obj, c.expected, conditionalStatus, elapsed, length, err)
+	if config.Verbose {
+		fmt.Printf("%s object %s/%s with status %d\n", name, obj.ObjectBucket, obj.ObjectKey, statusCode(err))
+	}
+	obj.ReleaseObject(err)
+}
+
+func conditionalHeadObject() {
+	var obj objfactory.ObjectSpec
+	if !pickConditionalObject(&obj, "conditional head") {
+		return
+	}
+	c := conditionalCases[rand.Intn(len(conditionalCases))]
+	name := fmt.Sprintf("conditionalHeadObject-%s", c.name)
+	p := c.build(&obj)
+	input := &s3.HeadObjectInput{
+		Bucket:            aws.String(obj.ObjectBucket),
+		Key:               aws.String(obj.ObjectKey),
+		IfMatch:           p.ifMatch,
+		IfNoneMatch:       p.ifNoneMatch,
+		IfModifiedSince:   p.ifModifiedSince,
+		IfUnmodifiedSince: p.ifUnmodifiedSince,
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(&obj)
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	_, err := sharedServiceClient.HeadObject(input)
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	recordExpectedStatus(name, &obj, c.expected, conditionalStatus, elapsed, int64(10), err)
+	if config.Verbose {
+		fmt.Printf("%s object %s/%s with status %d\n", name, obj.ObjectBucket, obj.ObjectKey, statusCode(err))
+	}
+	obj.ReleaseObject(err)
+}
+
+// conditionalPutObject creates a new object with If-None-Match: * which should succeed,
+// then uploads the same key again with the same condition which should be rejected.
+func conditionalPutObject() {
+	var obj objfactory.ObjectSpec
+	if err := obj.GetObject(objfactory.Write); err != nil {
+		time.Sleep(1000 * time.Millisecond)
+		return
+	}
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	req, out := newPutObjectRequest(&obj)
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+	err := req.Send()
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	recordExpectedStatus("conditionalPutObject-create", &obj, http.StatusOK, conditionalStatus, elapsed, obj.ObjectSize, err)
+	if err != nil {
+		obj.ReleaseObject(err)
+		return
+	}
+	saveObjectInfo(&obj, req, out)
+
+	if _, err := obj.ObjectData.Seek(0, io.SeekStart); err != nil {
+		boomer.RecordFailure("s3", "conditionalPutObject-exists", 0, "failed to rewind body with "+err.Error())
+		obj.ReleaseObject(nil)
+		return
+	}
+	start = time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	req, _ = newPutObjectRequest(&obj)
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+	overwriteErr := req.Send()
+	elapsed = time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	recordExpectedStatus("conditionalPutObject-exists", &obj, http.StatusPreconditionFailed, conditionalStatus,
+		elapsed, obj.ObjectSize, overwriteErr)
+	if config.Verbose {
+		fmt.Printf("conditional put object %s/%s got status %d on existing key\n",
+			obj.ObjectBucket, obj.ObjectKey, statusCode(overwriteErr))
+	}
+	// the object was created by the first request, cache it no matter how the second ends
+	obj.ReleaseObject(nil)
+}
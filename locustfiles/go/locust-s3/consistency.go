@@ -0,0 +1,261 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/myzhan/boomer"
+)
+
+// consistencyRequestType reports violations of read-after-write and list-after-write
+// consistency apart from other failures
+const consistencyRequestType = "consistency"
+
+// expectedState is what any read of an object should see after a write or delete
+type expectedState struct {
+	obj     objfactory.ObjectSpec // without data
+	op      string                // putObject, overwriteObject or deleteObject
+	exists  bool
+	written time.Time // when the write or delete finished
+	gen     int64
+}
+
+// violation is a line of the consistency report
+type violation struct {
+	Time     time.Time `json:"time"`
+	Written  time.Time `json:"written"`
+	Op       string    `json:"op"`
+	Check    string    `json:"check"`
+	Delay    string    `json:"delay"`
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Expected string    `json:"expected"`
+	Got      string    `json:"got"`
+}
+
+// consistencyChecker checks objects after writes and deletes of this runner. delayed checks
+// are skipped if the object was written or deleted again by this runner in the meantime.
+type consistencyChecker struct {
+	mutex  sync.Mutex
+	report *os.File
+	gens   map[string]*objectGen
+}
+
+// objectGen counts writes of an object, and checks still waiting for it
+type objectGen struct {
+	gen     int64
+	pending int
+}
+
+var checker *consistencyChecker
+
+func init() {
+	if !config.LoadConf.Data.Consistency.Enabled {
+		return
+	}
+	path := config.LoadConf.Data.Consistency.Report
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("failed to open consistency report %s with %s", path, err.Error())
+	}
+	checker = &consistencyChecker{report: f, gens: make(map[string]*objectGen)}
+}
+
+// checkConsistency checks obj right away and after each configured delay, if consistency
+// checks are enabled. exists tells if op left the object in place or deleted it.
+func checkConsistency(op string, obj *objfactory.ObjectSpec, exists bool) {
+	if checker == nil {
+		return
+	}
+	state := &expectedState{op: op, exists: exists, written: time.Now()}
+	state.obj = *obj
+	state.obj.ObjectData = nil
+	delays := config.LoadConf.Data.Consistency.Delays
+	state.gen = checker.begin(state.obj.ObjectBucket+"/"+state.obj.ObjectKey, len(delays))
+
+	checker.checkAll(state, 0)
+	for _, delay := range delays {
+		delay := delay
+		time.AfterFunc(delay, func() {
+			if checker.end(state) {
+				checker.checkAll(state, delay)
+			}
+		})
+	}
+}
+
+// forgetConsistency stops delayed checks of obj, after a change whose outcome is not known,
+// e.g. a delete of a version which brings back an older one
+func forgetConsistency(obj *objfactory.ObjectSpec) {
+	if checker == nil {
+		return
+	}
+	checker.begin(obj.ObjectBucket+"/"+obj.ObjectKey, 0)
+}
+
+// begin counts a new write of the object which has pending delayed checks
+func (c *consistencyChecker) begin(id string, pending int) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	g, ok := c.gens[id]
+	if !ok {
+		g = &objectGen{}
+		c.gens[id] = g
+	}
+	g.gen++
+	g.pending += pending
+	if g.pending == 0 {
+		delete(c.gens, id)
+	}
+	return g.gen
+}
+
+// end finishes a delayed check, and tells if the object is still as the check expects
+func (c *consistencyChecker) end(state *expectedState) bool {
+	id := state.obj.ObjectBucket + "/" + state.obj.ObjectKey
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	g := c.gens[id]
+	if g == nil {
+		return false
+	}
+	g.pending--
+	if g.pending == 0 {
+		delete(c.gens, id)
+	}
+	return g.gen == state.gen
+}
+
+func (c *consistencyChecker) checkAll(state *expectedState, delay time.Duration) {
+	for _, check := range config.LoadConf.Data.Consistency.Checks {
+		name := fmt.Sprintf("%s-after-%s@%s", check, state.op, delay)
+		start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+		expected, got, err := c.check(check, state)
+		elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+		switch {
+		case err != nil:
+			boomer.RecordFailure("s3", name, elapsed, err.Error())
+		case expected != got:
+			boomer.RecordFailure(consistencyRequestType, name, elapsed,
+				fmt.Sprintf("%s/%s expect %s but got %s", state.obj.ObjectBucket, state.obj.ObjectKey, expected, got))
+			c.record(violation{
+				Time:     time.Now(),
+				Written:  state.written,
+				Op:       state.op,
+				Check:    check,
+				Delay:    delay.String(),
+				Bucket:   state.obj.ObjectBucket,
+				Key:      state.obj.ObjectKey,
+				Expected: expected,
+				Got:      got,
+			})
+		default:
+			boomer.RecordSuccess(consistencyRequestType, name, elapsed, 0)
+		}
+	}
+}
+
+// describe formats what a check sees of an object
+func describe(exists bool, size int64, etag string) string {
+	if !exists {
+		return "absent"
+	}
+	return fmt.Sprintf("size %d etag %s", size, etag)
+}
+
+// check reads the object by a check, and returns what is expected and what is seen. an error
+// is returned if the check could not tell, e.g. the request failed for other reasons.
+func (c *consistencyChecker) check(check string, state *expectedState) (expected, got string, err error) {
+	obj := &state.obj
+	expected = describe(state.exists, obj.ObjectSize, obj.ETag)
+	switch check {
+	case config.CheckHead:
+		input := &s3.HeadObjectInput{Bucket: aws.String(obj.ObjectBucket), Key: aws.String(obj.ObjectKey)}
+		input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(obj)
+		resp, err := sharedServiceClient.HeadObject(input)
+		if statusCode(err) == http.StatusNotFound {
+			return expected, describe(false, 0, ""), nil
+		}
+		if err != nil {
+			return expected, "", err
+		}
+		return expected, describe(true, aws.Int64Value(resp.ContentLength), aws.StringValue(resp.ETag)), nil
+	case config.CheckGet:
+		input := &s3.GetObjectInput{Bucket: aws.String(obj.ObjectBucket), Key: aws.String(obj.ObjectKey)}
+		input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(obj)
+		resp, err := sharedServiceClient.GetObjectWithContext(context.Background(), input, withAcceptEncoding("identity"))
+		if statusCode(err) == http.StatusNotFound {
+			return expected, describe(false, 0, ""), nil
+		}
+		if err != nil {
+			return expected, "", err
+		}
+		defer resp.Body.Close()
+		length, err := io.Copy(ioutil.Discard, resp.Body)
+		if err != nil {
+			return expected, "", err
+		}
+		return expected, describe(true, length, aws.StringValue(resp.ETag)), nil
+	case config.CheckList:
+		resp, err := sharedServiceClient.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:  aws.String(obj.ObjectBucket),
+			Prefix:  aws.String(obj.ObjectKey),
+			MaxKeys: aws.Int64(1),
+		})
+		if err != nil {
+			return expected, "", err
+		}
+		// keys sharing the key as prefix are listed after the key itself
+		for _, o := range resp.Contents {
+			if aws.StringValue(o.Key) == obj.ObjectKey {
+				return expected, describe(true, aws.Int64Value(o.Size), aws.StringValue(o.ETag)), nil
+			}
+		}
+		return expected, describe(false, 0, ""), nil
+	default:
+		return expected, "", fmt.Errorf("unsupported consistency check %s", check)
+	}
+}
+
+// record appends a violation to the report
+func (c *consistencyChecker) record(v violation) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("failed to encode consistency violation with %s\n", err.Error())
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, err := c.report.Write(append(line, '\n')); err != nil {
+		fmt.Printf("failed to write consistency report with %s\n", err.Error())
+	}
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// SSE-C only supports AES256. the SDK takes care of base64 encoding the key
+// and computing the key MD5 header.
+const sseCustomerAlgorithm = "AES256"
+
+// serverSideEncryption returns the x-amz-server-side-encryption and kms key id
+// headers for the configured encryption mode. both are nil for SSE-C and no encryption.
+func serverSideEncryption() (sse *string, kmsKeyID *string) {
+	switch config.LoadConf.Data.Encryption.Mode {
+	case config.EncryptionSSES3:
+		return aws.String(s3.ServerSideEncryptionAes256), nil
+	case config.EncryptionSSEKMS:
+		if config.LoadConf.Data.Encryption.KmsKeyID != "" {
+			kmsKeyID = aws.String(config.LoadConf.Data.Encryption.KmsKeyID)
+		}
+		return aws.String(s3.ServerSideEncryptionAwsKms), kmsKeyID
+	default:
+		return nil, nil
+	}
+}
+
+// sseCustomerKey returns the SSE-C algorithm and key of an object. both are nil if
+// the object is not encrypted with a customer provided key.
+func sseCustomerKey(obj *objfactory.ObjectSpec) (algorithm *string, key *string) {
+	if obj.SSECustomerKey == "" {
+		return nil, nil
+	}
+	return aws.String(sseCustomerAlgorithm), aws.String(obj.SSECustomerKey)
+}
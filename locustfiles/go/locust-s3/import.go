@@ -0,0 +1,113 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// importFilter decides which listed objects are imported
+type importFilter struct {
+	minSize int64
+	maxSize int64
+	match   *regexp.Regexp
+}
+
+func (f *importFilter) accept(o *s3.Object) bool {
+	size := aws.Int64Value(o.Size)
+	if size < f.minSize || (f.maxSize > 0 && size > f.maxSize) {
+		return false
+	}
+	return f.match == nil || f.match.MatchString(aws.StringValue(o.Key))
+}
+
+// importObjects lists existing objects and loads them into the object catalog, so reads
+// could run against a dataset written by other tools
+func importObjects(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	buckets := fs.String("buckets", strings.Join(config.LoadConf.Data.Buckets, ","), "comma separated buckets to list")
+	prefixes := fs.String("prefixes", config.LoadConf.Data.ObjectPrefix, "comma separated key prefixes to list")
+	minSize := fs.Int64("min-size", 0, "skip objects smaller than this")
+	maxSize := fs.Int64("max-size", 0, "skip objects larger than this, 0 means no limit")
+	match := fs.String("match", "", "only import keys matching this regular expression")
+	fs.Parse(args)
+
+	filter := &importFilter{minSize: *minSize, maxSize: *maxSize}
+	if *match != "" {
+		var err error
+		if filter.match, err = regexp.Compile(*match); err != nil {
+			log.Fatalf("invalid key pattern %s with %s", *match, err.Error())
+		}
+	}
+	catalog := mustCatalog()
+	// memory cache is gone with this process, imported objects would be unknown to runners
+	if config.LoadConf.Cache.Type == config.CacheMemory {
+		log.Fatalln("import command needs a redis or disk cache")
+	}
+
+	sharedServiceClient = initS3Client()
+	var imported, skipped int64
+	var wg sync.WaitGroup
+	for _, b := range strings.Split(*buckets, ",") {
+		for _, p := range strings.Split(*prefixes, ",") {
+			wg.Add(1)
+			go func(bucket, prefix string) {
+				defer wg.Done()
+				input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)}
+				err := sharedServiceClient.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+					for _, o := range page.Contents {
+						if !filter.accept(o) {
+							atomic.AddInt64(&skipped, 1)
+							continue
+						}
+						obj := &objfactory.ObjectSpec{
+							ObjectBucket: bucket,
+							ObjectKey:    aws.StringValue(o.Key),
+							ObjectSize:   aws.Int64Value(o.Size),
+							ETag:         aws.StringValue(o.ETag),
+							LastModified: aws.TimeValue(o.LastModified),
+						}
+						obj.MarkUnknownPayload()
+						obj.ReadOnly = true
+						if err := catalog.Add(obj); err != nil {
+							log.Fatalf("failed to add %s/%s to catalog with %s", bucket, obj.ObjectKey, err.Error())
+						}
+						atomic.AddInt64(&imported, 1)
+					}
+					return true
+				})
+				if err != nil {
+					fmt.Printf("failed to list %s/%s with %s\n", bucket, prefix, err.Error())
+				}
+			}(b, p)
+		}
+	}
+	wg.Wait()
+	fmt.Printf("imported %d objects, skipped %d objects\n", imported, skipped)
+}
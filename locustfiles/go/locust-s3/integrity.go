@@ -0,0 +1,151 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory/payload"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/myzhan/boomer"
+)
+
+// ranged GET reads at most this many bytes
+const maxRangeSize = 8 << 20
+
+// corruptedError is content of an object which differs from what was written
+type corruptedError struct {
+	error
+}
+
+// readBody reads body of obj into the configured sink. body starts at offset off of the
+// object and should have expected bytes. if integrity_check is enabled, content is generated
+// again and compared byte for byte, and a difference is returned as corruptedError. time
+// spent in the sink is returned too, and a failure of the sink as sinkError.
+func readBody(obj *objfactory.ObjectSpec, body io.Reader, off, expected int64) (int64, time.Duration, error) {
+	// without a sink, body is dropped by ioutil.Discard, which reads it with a pooled buffer
+	if !sinkEnabled() {
+		length, err := verifyBody(obj, body, ioutil.Discard, off, expected)
+		return length, 0, err
+	}
+	s, err := newSink()
+	if err != nil {
+		return 0, 0, err
+	}
+	length, err := verifyBody(obj, body, s, off, expected)
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	return length, s.elapsed, err
+}
+
+func verifyBody(obj *objfactory.ObjectSpec, body io.Reader, s io.Writer, off, expected int64) (int64, error) {
+	gen := obj.Payload()
+	if !config.LoadConf.Data.IntegrityCheck || gen == nil {
+		return io.Copy(s, body)
+	}
+	length, err := payload.Verify(io.TeeReader(body, s), gen, off)
+	if err != nil {
+		if mismatch, ok := err.(*payload.MismatchError); ok {
+			return length, corruptedError{mismatch}
+		}
+		return length, err
+	}
+	if length != expected {
+		return length, corruptedError{fmt.Errorf("expect %d bytes from offset %d but got %d", expected, off, length)}
+	}
+	return length, nil
+}
+
+// recordRead reports a finished read of obj under requestType. corrupted content is a correctness
+// failure. time spent in the sink is taken out of elapsed and reported on its own.
+func recordRead(requestType, name string, obj *objfactory.ObjectSpec, elapsed int64, sinkTime time.Duration, length int64, err error) {
+	sinkElapsed := sinkTime.Nanoseconds() / config.LoadConf.Locust.TimeResolution
+	elapsed -= sinkElapsed
+	switch err.(type) {
+	case nil:
+		boomer.RecordSuccess(requestType, name, elapsed, length)
+		if sinkEnabled() {
+			boomer.RecordSuccess(sinkRequestType, name, sinkElapsed, length)
+		}
+		if config.Verbose {
+			fmt.Printf("%s object %s/%s\n", name, obj.ObjectBucket, obj.ObjectKey)
+		}
+	case corruptedError:
+		boomer.RecordFailure(correctnessRequestType, name, elapsed,
+			fmt.Sprintf("%s/%s %s", obj.ObjectBucket, obj.ObjectKey, err.Error()))
+	case sinkError:
+		boomer.RecordFailure(sinkRequestType, name, sinkElapsed,
+			fmt.Sprintf("sink of %s/%s failed with %s", obj.ObjectBucket, obj.ObjectKey, err.Error()))
+	default:
+		boomer.RecordFailure(requestType, name, elapsed,
+			fmt.Sprintf("get %s/%s failed with %s", obj.ObjectBucket, obj.ObjectKey, err.Error()))
+	}
+}
+
+// getObjectRange reads a random range of a cached object
+func getObjectRange() {
+	var obj objfactory.ObjectSpec
+	if err := obj.GetObject(objfactory.Read); err != nil {
+		if config.Verbose {
+			fmt.Println("no object for ranged get operation from cache, will sleep 1sec and retry")
+		}
+		time.Sleep(1000 * time.Millisecond)
+		return
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(obj.ObjectBucket),
+		Key:    aws.String(obj.ObjectKey),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(&obj)
+	// an empty object has no range to read, the whole object is read instead
+	var off, size int64
+	if obj.ObjectSize > 0 {
+		off = rand.Int63n(obj.ObjectSize)
+		size = 1 + rand.Int63n(min64(obj.ObjectSize-off, maxRangeSize))
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", off, off+size-1))
+	}
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	resp, err := sharedServiceClient.GetObject(input)
+	var length int64
+	var sinkTime time.Duration
+	if err == nil {
+		length, sinkTime, err = readBody(&obj, throttleDownload(resp.Body), off, size)
+		resp.Body.Close()
+	}
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	recordRead("s3", "getObjectRange", &obj, elapsed, sinkTime, length, err)
+	obj.ReleaseObject(err)
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
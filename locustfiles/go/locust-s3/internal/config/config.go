@@ -21,15 +21,131 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"testing"
+	"time"
 
 	pretty "github.com/tonnerre/golang-pretty"
 	"gopkg.in/yaml.v2"
 )
 
+// S3 limits of tags and user metadata of an object
+const (
+	maxTagCount    = 10
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+	maxMetadataLen = 2048 // bytes of all keys and values
+)
+
+// S3 rejects parts of a multipart upload smaller than this, except the last one
+const minPartSize = 5 << 20
+
+// name prefixes of generated metadata and tags
+const (
+	MetadataPrefix = "lt-meta-"
+	TagPrefix      = "lt-tag-"
+)
+
+// object catalog types
+const (
+	CacheRedis  = "redis"
+	CacheMemory = "memory"
+	CacheDisk   = "disk"
+)
+
+// object lock retention modes
+const (
+	RetentionGovernance = "GOVERNANCE"
+	RetentionCompliance = "COMPLIANCE"
+)
+
+// server side encryption modes
+const (
+	EncryptionNone   = "none"
+	EncryptionSSES3  = "sse-s3"
+	EncryptionSSEKMS = "sse-kms"
+	EncryptionSSEC   = "sse-c"
+)
+
+// object size distributions
+const (
+	SizeWeighted    = "weighted"
+	SizeFixed       = "fixed"
+	SizeLogNormal   = "lognormal"
+	SizePareto      = "pareto"
+	SizeExponential = "exponential"
+	SizeEmpirical   = "empirical"
+)
+
+// payload modes of uploaded objects
+const (
+	PayloadShared = "shared"
+	PayloadUnique = "unique"
+	PayloadZeros  = "zeros"
+	PayloadCorpus = "corpus"
+)
+
+// sinks of downloaded objects
+const (
+	SinkDiscard = "discard"
+	SinkHash    = "hash"
+	SinkFile    = "file"
+)
+
+// orders of files picked from the corpus
+const (
+	CorpusRandom     = "random"
+	CorpusSequential = "sequential"
+)
+
+// access distributions of objects picked for read
+const (
+	AccessUniform = "uniform"
+	AccessZipf    = "zipf"
+	AccessHotspot = "hotspot"
+	AccessRecent  = "recent"
+)
+
 // Verbose with true will lead to more verbose debug message
 var Verbose = false
 
+// Bandwidth limits in bytes per second, 0 means no limit
+type Bandwidth struct {
+	PerRequest int64 `yaml:"per_request"`
+	Global     int64 `yaml:"global"`
+}
+
+// checks of consistency after writes and deletes
+const (
+	CheckHead = "head"
+	CheckGet  = "get"
+	CheckList = "list"
+)
+
+// operations of scenario steps
+const (
+	StepPut    = "put"
+	StepHead   = "head"
+	StepGet    = "get"
+	StepCopy   = "copy"
+	StepDelete = "delete"
+)
+
+// Scenario is a sequence of operations a virtual user runs on one object
+type Scenario struct {
+	Name   string         `yaml:"name"`
+	Weight int            `yaml:"weight"`
+	Steps  []ScenarioStep `yaml:"steps"`
+}
+
+// ScenarioStep runs an operation repeat times, after waiting think time each time
+type ScenarioStep struct {
+	Op     string        `yaml:"op"`
+	Repeat int           `yaml:"repeat"`
+	Think  time.Duration `yaml:"think"`
+}
+
 // Go unfortunately has quite poort YAML parsing support.
 // have to paste sample.yaml to https://mengzhuo.github.io/yaml-to-go/ to get this structure
 // also would like to map Weights to map of map like map[string]map[string]string `yaml:"weights"`
@@ -39,12 +155,25 @@ type LocustS3Configuration struct {
 	Locust struct {
 		TimeResolution int64 `yaml:"time_resolution"`
 		TimeDelay      int64 `yaml:"time_delay"`
+		Seed           int64 `yaml:"seed"`
 	} `yaml:"locust"`
 	Cache struct {
-		Server string `yaml:"server"`
-		Port   string `yaml:"port"`
-		Db     string `yaml:"db"`
+		Type      string        `yaml:"type"`
+		Path      string        `yaml:"path"`
+		Server    string        `yaml:"server"`
+		Port      string        `yaml:"port"`
+		Db        string        `yaml:"db"`
+		Namespace string        `yaml:"namespace"`
+		RunID     string        `yaml:"run_id"`
+		PickBatch int           `yaml:"pick_batch"`
+		Lease     time.Duration `yaml:"lease"`
 	} `yaml:"cache"`
+	Prepare struct {
+		Objects int64 `yaml:"objects"`
+		Bytes   int64 `yaml:"bytes"`
+		Workers int   `yaml:"workers"`
+		OnStart bool  `yaml:"on_start"`
+	} `yaml:"prepare"`
 	Counter struct {
 		Server string `yaml:"server"`
 		Port   string `yaml:"port"`
@@ -59,12 +188,74 @@ type LocustS3Configuration struct {
 	} `yaml:"s3"`
 	Data struct {
 		CacheResult         bool                         `yaml:"cache_result"`
+		CacheETag           bool                         `yaml:"cache_etag"`
 		IntegrityCheck      bool                         `yaml:"integrity_check"`
 		Buckets             []string                     `yaml:"buckets"`
 		CreateBucketOnStart bool                         `yaml:"create_bucket_on_start"`
 		ObjectPrefix        string                       `yaml:"object_prefix"`
 		SizingOption        string                       `yaml:"sizing_option"`
 		Weights             map[string]map[string]uint32 `yaml:"weights"`
+		Consistency         struct {
+			Enabled bool            `yaml:"enabled"`
+			Checks  []string        `yaml:"checks"`
+			Delays  []time.Duration `yaml:"delays"`
+			Report  string          `yaml:"report"`
+		} `yaml:"consistency"`
+		SizeDistribution struct {
+			Type      string  `yaml:"type"`
+			Size      int64   `yaml:"size"`
+			Median    float64 `yaml:"median"`
+			Sigma     float64 `yaml:"sigma"`
+			Scale     float64 `yaml:"scale"`
+			Shape     float64 `yaml:"shape"`
+			Mean      float64 `yaml:"mean"`
+			Histogram string  `yaml:"histogram"`
+			Min       int64   `yaml:"min"`
+			Max       int64   `yaml:"max"`
+		} `yaml:"size_distribution"`
+		ObjectLock struct {
+			Enabled          bool `yaml:"enabled"`
+			DefaultRetention struct {
+				Mode string `yaml:"mode"`
+				Days int64  `yaml:"days"`
+			} `yaml:"default_retention"`
+			Retention struct {
+				Mode     string        `yaml:"mode"`
+				Duration time.Duration `yaml:"duration"`
+			} `yaml:"retention"`
+			LegalHold bool `yaml:"legal_hold"`
+		} `yaml:"object_lock"`
+		Encryption struct {
+			Mode     string `yaml:"mode"`
+			KmsKeyID string `yaml:"kms_key_id"`
+		} `yaml:"encryption"`
+		Payload struct {
+			Mode             string  `yaml:"mode"`
+			CompressionRatio float64 `yaml:"compression_ratio"`
+			DedupRatio       float64 `yaml:"dedup_ratio"`
+			DedupBlockSize   int64   `yaml:"dedup_block_size"`
+			DedupPool        int64   `yaml:"dedup_pool"`
+			Corpus           struct {
+				Path        string `yaml:"path"`
+				Order       string `yaml:"order"`
+				KeyFromPath bool   `yaml:"key_from_path"`
+			} `yaml:"corpus"`
+		} `yaml:"payload"`
+		Key struct {
+			Template   string `yaml:"template"`
+			Length     int    `yaml:"length"`
+			Charset    string `yaml:"charset"`
+			Depth      int    `yaml:"depth"`
+			Fanout     int    `yaml:"fanout"`
+			HashLength int    `yaml:"hash_length"`
+		} `yaml:"key"`
+		Access struct {
+			Distribution  string  `yaml:"distribution"`
+			ZipfExponent  float64 `yaml:"zipf_exponent"`
+			HotSet        float64 `yaml:"hot_set"`
+			HotAccess     float64 `yaml:"hot_access"`
+			RecentMeanAge float64 `yaml:"recent_mean_age"`
+		} `yaml:"access"`
 	} `yaml:"data"`
 	Ops struct {
 		Weights struct {
@@ -73,9 +264,42 @@ type LocustS3Configuration struct {
 			GetObject    int `yaml:"get_object"`
 			HeadObject   int `yaml:"head_object"`
 			DeleteObject int `yaml:"delete_object"`
+			CopyObject   int `yaml:"copy_object"`
+
+			GetObjectRange int `yaml:"get_object_range"`
+
+			DeleteLockedObject int `yaml:"delete_locked_object"`
+
+			PutBucketPolicy    int `yaml:"put_bucket_policy"`
+			GetBucketPolicy    int `yaml:"get_bucket_policy"`
+			DeleteBucketPolicy int `yaml:"delete_bucket_policy"`
+			PutBucketAcl       int `yaml:"put_bucket_acl"`
+			GetBucketAcl       int `yaml:"get_bucket_acl"`
+			PutObjectAcl       int `yaml:"put_object_acl"`
+			GetObjectAcl       int `yaml:"get_object_acl"`
+			PutBucketCors      int `yaml:"put_bucket_cors"`
+			GetBucketCors      int `yaml:"get_bucket_cors"`
+			DeleteBucketCors   int `yaml:"delete_bucket_cors"`
+
+			PutObjectTagging    int `yaml:"put_object_tagging"`
+			GetObjectTagging    int `yaml:"get_object_tagging"`
+			DeleteObjectTagging int `yaml:"delete_object_tagging"`
+
+			ConditionalGetObject  int `yaml:"conditional_get_object"`
+			ConditionalHeadObject int `yaml:"conditional_head_object"`
+			ConditionalPutObject  int `yaml:"conditional_put_object"`
+
+			OverwriteObject int `yaml:"overwrite_object"`
 		} `yaml:"weights"`
 		GetObject struct {
 			Threading bool `yaml:"threading"`
+			Sink      struct {
+				Type  string `yaml:"type"`
+				Hash  string `yaml:"hash"`
+				Dir   string `yaml:"dir"`
+				Fsync bool   `yaml:"fsync"`
+				Rate  int64  `yaml:"rate"`
+			} `yaml:"sink"`
 		} `yaml:"get_object"`
 		PutObject struct {
 			Limit struct {
@@ -83,15 +307,53 @@ type LocustS3Configuration struct {
 				SizeCounter string `yaml:"size_counter"`
 				SizeLimit   string `yaml:"size_limit"`
 			} `yaml:"limit"`
+			Metadata struct {
+				Count int `yaml:"count"`
+				Size  int `yaml:"size"`
+			} `yaml:"metadata"`
+			Tags struct {
+				Count int `yaml:"count"`
+				Size  int `yaml:"size"`
+			} `yaml:"tags"`
+			Multipart struct {
+				Threshold   int64 `yaml:"threshold"`
+				PartSize    int64 `yaml:"part_size"`
+				Concurrency int   `yaml:"concurrency"`
+			} `yaml:"multipart"`
 		} `yaml:"put_object"`
+		ObjectTagging struct {
+			Count int `yaml:"count"`
+			Size  int `yaml:"size"`
+		} `yaml:"object_tagging"`
+		BucketPolicy struct {
+			Statements int `yaml:"statements"`
+		} `yaml:"bucket_policy"`
+		BucketCors struct {
+			Rules int `yaml:"rules"`
+		} `yaml:"bucket_cors"`
+		Throttle struct {
+			Upload   Bandwidth `yaml:"upload"`
+			Download Bandwidth `yaml:"download"`
+		} `yaml:"throttle"`
+		Scenarios []Scenario `yaml:"scenarios"`
 	} `yaml:"ops"`
 }
 
+// AttributeName is the name of i-th generated metadata or tag
+func AttributeName(prefix string, i int) string {
+	return prefix + strconv.Itoa(i)
+}
+
 // GetConf will load configuration
 func (c *LocustS3Configuration) GetConf() *LocustS3Configuration {
 	var yamlFile []byte
 	var err error
-	if yamlFile, err = ioutil.ReadFile(os.Getenv("LOCUST_CONFIG")); err != nil {
+	path, set := os.LookupEnv("LOCUST_CONFIG")
+	if !set && testing.Testing() {
+		// tests of a package load the configuration in testdata of the package
+		path = "testdata/locust.yaml"
+	}
+	if yamlFile, err = ioutil.ReadFile(path); err != nil {
 		log.Fatalf("yamlFile.Get err   #%v ", err)
 	}
 	if err = yaml.Unmarshal(yamlFile, c); err != nil {
@@ -129,11 +391,373 @@ func (c *LocustS3Configuration) GetConf() *LocustS3Configuration {
 		c.S3.AccessSecret = value
 	}
 
+	c.Cache.Type = strings.ToLower(c.Cache.Type)
+	if c.Cache.Type == "" {
+		// keep using redis for existing configurations
+		if c.Cache.Server != "" {
+			c.Cache.Type = CacheRedis
+		} else {
+			c.Cache.Type = CacheMemory
+		}
+	}
+	if c.Cache.Namespace == "" {
+		c.Cache.Namespace = "locust-s3"
+	}
+	if value, present = os.LookupEnv("LT_SEED"); present {
+		if c.Locust.Seed, err = strconv.ParseInt(value, 10, 64); err != nil {
+			log.Fatalf("invalid seed #%v", value)
+		}
+	}
+	if value, present = os.LookupEnv("LT_RUN_ID"); present {
+		c.Cache.RunID = value
+	}
+	if c.Cache.RunID == "" {
+		c.Cache.RunID = "default"
+	}
+	if strings.ContainsAny(c.Cache.RunID, ":/") {
+		log.Fatalf("invalid run id #%v, it could not contain : or /", c.Cache.RunID)
+	}
+	if c.Cache.PickBatch <= 0 {
+		c.Cache.PickBatch = 16
+	}
+	if c.Cache.Lease <= 0 {
+		c.Cache.Lease = 5 * time.Minute
+	}
+	if c.Cache.Type == CacheDisk && c.Cache.Path == "" {
+		c.Cache.Path = "locust-s3-catalog.db"
+	}
+	if value, present = os.LookupEnv("LT_CACHE_PATH"); present {
+		c.Cache.Path = value
+	}
+	if (c.Ops.Weights.GetObject > 0 || c.Ops.Weights.HeadObject > 0 || c.Ops.Weights.DeleteObject > 0 ||
+		c.Ops.Weights.GetObjectRange > 0 || c.Ops.Weights.OverwriteObject > 0) &&
+		!c.Data.CacheResult {
+		log.Fatalf("can not do GET/HEAD/DELETE if cache_result is not enabled")
+	}
+
+	if c.Prepare.Workers <= 0 {
+		c.Prepare.Workers = 16
+	}
+	if c.Prepare.OnStart && (!c.Data.CacheResult || (c.Prepare.Objects <= 0 && c.Prepare.Bytes <= 0)) {
+		log.Fatalf("prepare on start needs cache_result and a target number of objects or bytes")
+	}
+
 	c.S3.SignatureVersion = strings.ToLower(c.S3.SignatureVersion)
 	if c.S3.SignatureVersion != "s3" && c.S3.SignatureVersion != "s3v4" {
 		log.Fatalf("invalid signature version #%v", c.S3.SignatureVersion)
 	}
 
+	if c.Ops.BucketPolicy.Statements <= 0 {
+		c.Ops.BucketPolicy.Statements = 1
+	}
+	if c.Ops.BucketCors.Rules <= 0 {
+		c.Ops.BucketCors.Rules = 1
+	}
+
+	c.Data.Encryption.Mode = strings.ToLower(c.Data.Encryption.Mode)
+	switch c.Data.Encryption.Mode {
+	case "":
+		c.Data.Encryption.Mode = EncryptionNone
+	case EncryptionNone, EncryptionSSES3, EncryptionSSEKMS, EncryptionSSEC:
+	default:
+		log.Fatalf("invalid encryption mode #%v", c.Data.Encryption.Mode)
+	}
+	// SDK refuses to send customer keys in clear text, endpoints without scheme are https
+	if c.Data.Encryption.Mode == EncryptionSSEC && strings.HasPrefix(strings.ToLower(c.S3.Endpoint), "http://") {
+		log.Fatalf("sse-c needs an https endpoint, but endpoint is #%v", c.S3.Endpoint)
+	}
+
+	if (c.Ops.Weights.ConditionalGetObject > 0 || c.Ops.Weights.ConditionalHeadObject > 0) && !c.Data.CacheETag {
+		log.Fatalf("conditional GET/HEAD need cache_etag to be enabled")
+	}
+
+	c.Data.ObjectLock.DefaultRetention.Mode = strings.ToUpper(c.Data.ObjectLock.DefaultRetention.Mode)
+	c.Data.ObjectLock.Retention.Mode = strings.ToUpper(c.Data.ObjectLock.Retention.Mode)
+	for _, mode := range []string{c.Data.ObjectLock.DefaultRetention.Mode, c.Data.ObjectLock.Retention.Mode} {
+		if mode != "" && mode != RetentionGovernance && mode != RetentionCompliance {
+			log.Fatalf("invalid object lock retention mode #%v", mode)
+		}
+	}
+	if c.Data.ObjectLock.DefaultRetention.Mode != "" && c.Data.ObjectLock.DefaultRetention.Days <= 0 {
+		log.Fatalf("default retention of object lock needs a positive days")
+	}
+	if c.Data.ObjectLock.Retention.Mode != "" && c.Data.ObjectLock.Retention.Duration <= 0 {
+		log.Fatalf("retention of object lock needs a positive duration")
+	}
+	if c.Ops.Weights.DeleteLockedObject > 0 && !c.Data.ObjectLock.Enabled {
+		log.Fatalf("delete locked object needs object lock to be enabled")
+	}
+
+	size := &c.Data.SizeDistribution
+	size.Type = strings.ToLower(size.Type)
+	switch size.Type {
+	case "":
+		size.Type = SizeWeighted
+	case SizeWeighted:
+	case SizeFixed:
+		if size.Size < 0 {
+			log.Fatalf("invalid fixed size #%v", size.Size)
+		}
+	case SizeLogNormal:
+		if size.Median <= 0 || size.Sigma <= 0 {
+			log.Fatalf("log-normal size distribution needs a positive median and sigma")
+		}
+	case SizePareto:
+		if size.Scale <= 0 || size.Shape <= 0 {
+			log.Fatalf("pareto size distribution needs a positive scale and shape")
+		}
+	case SizeExponential:
+		if size.Mean <= 0 {
+			log.Fatalf("exponential size distribution needs a positive mean")
+		}
+	case SizeEmpirical:
+		if size.Histogram == "" {
+			log.Fatalf("empirical size distribution needs a histogram file")
+		}
+	default:
+		log.Fatalf("invalid size distribution #%v", size.Type)
+	}
+	if size.Min < 0 || (size.Max > 0 && size.Max < size.Min) {
+		log.Fatalf("invalid size limits, min #%v and max #%v", size.Min, size.Max)
+	}
+
+	if c.Data.IntegrityCheck && c.Locust.Seed == 0 {
+		log.Fatalf("integrity_check of Go runner needs a fixed seed to generate content again")
+	}
+
+	payload := &c.Data.Payload
+	payload.Mode = strings.ToLower(payload.Mode)
+	switch payload.Mode {
+	case "":
+		payload.Mode = PayloadShared
+	case PayloadShared, PayloadUnique, PayloadZeros:
+	case PayloadCorpus:
+		if payload.Corpus.Path == "" {
+			log.Fatalln("corpus payload needs a path of a directory or tarball")
+		}
+		switch payload.Corpus.Order {
+		case "":
+			payload.Corpus.Order = CorpusRandom
+		case CorpusRandom, CorpusSequential:
+		default:
+			log.Fatalf("invalid corpus order #%v", payload.Corpus.Order)
+		}
+		// a file is uploaded again under the same key, which a conditional create must reject
+		if payload.Corpus.KeyFromPath && c.Ops.Weights.ConditionalPutObject > 0 {
+			log.Fatalln("conditional_put_object needs new keys, which corpus key_from_path does not give")
+		}
+	default:
+		log.Fatalf("invalid payload mode #%v", payload.Mode)
+	}
+	if payload.CompressionRatio == 0 {
+		payload.CompressionRatio = 1
+	}
+	if payload.DedupRatio == 0 {
+		payload.DedupRatio = 1
+	}
+	if payload.CompressionRatio < 1 || payload.DedupRatio < 1 {
+		log.Fatalf("invalid compression ratio #%v or dedup ratio #%v, they should be at least 1",
+			payload.CompressionRatio, payload.DedupRatio)
+	}
+	if (payload.CompressionRatio > 1 || payload.DedupRatio > 1) && payload.Mode != PayloadUnique {
+		log.Fatalf("compression and dedup ratio only apply to unique payload")
+	}
+	if payload.DedupBlockSize <= 0 {
+		payload.DedupBlockSize = 4096
+	}
+	if payload.DedupPool <= 0 {
+		payload.DedupPool = 1024
+	}
+
+	key := &c.Data.Key
+	if key.Template == "" {
+		key.Template = "{prefix}{random}"
+	}
+	if key.Length <= 0 {
+		key.Length = 16
+	}
+	if key.Charset == "" {
+		key.Charset = "letters"
+	}
+	if key.Depth <= 0 {
+		key.Depth = 2
+	}
+	if key.Fanout <= 0 {
+		key.Fanout = 16
+	}
+	if key.HashLength <= 0 || key.HashLength > 16 {
+		key.HashLength = 4
+	}
+	// {seq} starts over at 1 each time a runner starts, only {worker} tells keys of runners apart
+	if strings.Contains(key.Template, "{seq}") && !strings.Contains(key.Template, "{worker}") {
+		log.Fatalf("key template %s has {seq} without {worker}, runners would overwrite each other's objects", key.Template)
+	}
+
+	access := &c.Data.Access
+	access.Distribution = strings.ToLower(access.Distribution)
+	switch access.Distribution {
+	case "":
+		access.Distribution = AccessUniform
+	case AccessUniform:
+	case AccessZipf:
+		if access.ZipfExponent == 0 {
+			access.ZipfExponent = 1.1
+		}
+		if access.ZipfExponent <= 1 {
+			log.Fatalf("invalid zipf exponent #%v, it should be greater than 1", access.ZipfExponent)
+		}
+	case AccessHotspot:
+		if access.HotSet == 0 {
+			access.HotSet = 20
+		}
+		if access.HotAccess == 0 {
+			access.HotAccess = 80
+		}
+		if access.HotSet <= 0 || access.HotSet >= 100 || access.HotAccess < 0 || access.HotAccess > 100 {
+			log.Fatalf("invalid hotspot of #%v%% objects with #%v%% access", access.HotSet, access.HotAccess)
+		}
+	case AccessRecent:
+		if access.RecentMeanAge == 0 {
+			access.RecentMeanAge = 1000
+		}
+		if access.RecentMeanAge < 0 {
+			log.Fatalf("invalid recent mean age #%v", access.RecentMeanAge)
+		}
+	default:
+		log.Fatalf("invalid access distribution #%v", access.Distribution)
+	}
+
+	// S3 allows at most 10 tags per object
+	if c.Ops.PutObject.Tags.Count > maxTagCount || c.Ops.ObjectTagging.Count > maxTagCount {
+		log.Fatalf("invalid tag count, at most %d tags are allowed per object", maxTagCount)
+	}
+	if c.Ops.PutObject.Tags.Size > maxTagValueLen || c.Ops.ObjectTagging.Size > maxTagValueLen {
+		log.Fatalf("invalid tag size, tag values are at most %d characters", maxTagValueLen)
+	}
+	for _, count := range []int{c.Ops.PutObject.Tags.Count, c.Ops.ObjectTagging.Count} {
+		if count > 0 && len(AttributeName(TagPrefix, count-1)) > maxTagKeyLen {
+			log.Fatalf("invalid tag count, tag keys are at most %d characters", maxTagKeyLen)
+		}
+	}
+	metadata := c.Ops.PutObject.Metadata
+	var metadataLen int
+	for i := 0; i < metadata.Count; i++ {
+		metadataLen += len(AttributeName(MetadataPrefix, i)) + metadata.Size
+	}
+	if metadataLen > maxMetadataLen {
+		log.Fatalf("invalid metadata, %d of size %d take %d bytes but at most %d bytes are allowed",
+			metadata.Count, metadata.Size, metadataLen, maxMetadataLen)
+	}
+	sink := &c.Ops.GetObject.Sink
+	sink.Type = strings.ToLower(sink.Type)
+	switch sink.Type {
+	case "":
+		sink.Type = SinkDiscard
+	case SinkDiscard, SinkFile:
+	case SinkHash:
+		sink.Hash = strings.ToLower(sink.Hash)
+		switch sink.Hash {
+		case "":
+			sink.Hash = "md5"
+		case "md5", "sha256", "crc32c":
+		default:
+			log.Fatalf("invalid sink hash #%v, should be md5, sha256 or crc32c", sink.Hash)
+		}
+	default:
+		log.Fatalf("invalid sink type #%v", sink.Type)
+	}
+	if sink.Rate < 0 {
+		log.Fatalf("invalid sink rate #%v", sink.Rate)
+	}
+
+	consistency := &c.Data.Consistency
+	if len(consistency.Checks) == 0 {
+		consistency.Checks = []string{CheckHead, CheckGet, CheckList}
+	}
+	for i, check := range consistency.Checks {
+		consistency.Checks[i] = strings.ToLower(check)
+		switch consistency.Checks[i] {
+		case CheckHead, CheckGet, CheckList:
+		default:
+			log.Fatalf("invalid consistency check #%v, should be head, get or list", check)
+		}
+	}
+	for _, delay := range consistency.Delays {
+		if delay < 0 {
+			log.Fatalf("invalid consistency delay #%v", delay)
+		}
+	}
+	// writes of other runners sharing a redis catalog are not known to a runner, so a delayed
+	// check could see an object changed by someone else
+	if consistency.Enabled && len(consistency.Delays) > 0 && c.Cache.Type == CacheRedis {
+		log.Fatalf("delayed consistency checks are not supported with redis cache")
+	}
+	if consistency.Report == "" {
+		consistency.Report = "consistency.jsonl"
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Ops.Scenarios {
+		sc := &c.Ops.Scenarios[i]
+		if sc.Name == "" || names[sc.Name] {
+			log.Fatalf("scenario #%d needs a unique name", i+1)
+		}
+		names[sc.Name] = true
+		if sc.Weight < 0 || len(sc.Steps) == 0 {
+			log.Fatalf("invalid scenario %s, it needs steps and a weight which is not negative", sc.Name)
+		}
+		for j := range sc.Steps {
+			step := &sc.Steps[j]
+			step.Op = strings.ToLower(step.Op)
+			switch {
+			case step.Op == StepPut && j > 0:
+				log.Fatalf("put could only be the first step of scenario %s", sc.Name)
+			case step.Op == StepDelete && j < len(sc.Steps)-1:
+				log.Fatalf("delete could only be the last step of scenario %s", sc.Name)
+			}
+			switch step.Op {
+			case StepPut, StepHead, StepGet, StepCopy, StepDelete:
+			default:
+				log.Fatalf("invalid op #%v of scenario %s", step.Op, sc.Name)
+			}
+			if step.Repeat == 0 {
+				step.Repeat = 1
+			}
+			if step.Repeat < 0 || step.Think < 0 {
+				log.Fatalf("invalid repeat #%v or think #%v of scenario %s", step.Repeat, step.Think, sc.Name)
+			}
+		}
+		// the object of a scenario comes from the catalog unless the scenario puts it
+		if sc.Steps[0].Op != StepPut && !c.Data.CacheResult {
+			log.Fatalf("scenario %s needs cache_result, or put as the first step", sc.Name)
+		}
+	}
+
+	multipart := &c.Ops.PutObject.Multipart
+	if multipart.PartSize == 0 {
+		multipart.PartSize = 8 << 20
+	}
+	if multipart.Concurrency == 0 {
+		multipart.Concurrency = 4
+	}
+	if multipart.Threshold < 0 || multipart.PartSize < minPartSize || multipart.Concurrency < 0 {
+		log.Fatalf("invalid multipart threshold #%v, part_size #%v or concurrency #%v, part_size should be at least 5MiB",
+			multipart.Threshold, multipart.PartSize, multipart.Concurrency)
+	}
+
+	for _, b := range []Bandwidth{c.Ops.Throttle.Upload, c.Ops.Throttle.Download} {
+		if b.PerRequest < 0 || b.Global < 0 {
+			log.Fatalf("invalid throttle, per_request #%v and global #%v should not be negative", b.PerRequest, b.Global)
+		}
+	}
+
+	if c.Ops.ObjectTagging.Count == 0 {
+		c.Ops.ObjectTagging.Count = 1
+	}
+	if c.Ops.ObjectTagging.Size == 0 {
+		c.Ops.ObjectTagging.Size = 16
+	}
+
 	/* FIXME bytefmt has difficulty to parse these stuff. giving up for now.
 	will need strict numerics in the yaml file.
 	WeightedSizeConf = make(map[string]WeightedSizeRange)
@@ -0,0 +1,207 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the configuration in testdata is loaded by init
+func TestDefaults(t *testing.T) {
+	c := &LoadConf
+	if tags := c.Ops.ObjectTagging; tags.Count != 1 || tags.Size != 16 {
+		t.Errorf("object tagging defaults are %d tags of size %d", tags.Count, tags.Size)
+	}
+	if c.Cache.RunID != "default" || c.Cache.PickBatch != 16 || c.Cache.Lease != 5*time.Minute {
+		t.Errorf("cache defaults are run id %s, pick batch %d and lease %v", c.Cache.RunID, c.Cache.PickBatch, c.Cache.Lease)
+	}
+	if m := c.Ops.PutObject.Multipart; m.PartSize != 8<<20 || m.Concurrency != 4 {
+		t.Errorf("multipart defaults are part size %d and concurrency %d", m.PartSize, m.Concurrency)
+	}
+	steps := c.Ops.Scenarios[0].Steps
+	if steps[0].Op != StepPut || steps[0].Repeat != 1 || steps[1].Repeat != 2 {
+		t.Errorf("scenario steps are %+v", steps)
+	}
+}
+
+// base of configurations to validate. sections below are added by each case.
+const validateBase = `
+locust :
+  time_resolution : 1000000
+s3 :
+  signature_version : s3v4
+`
+
+// loadConf loads conf in a new test process, where init exits on invalid configuration, and
+// returns the log of the process
+func loadConf(t *testing.T, conf string) (string, error) {
+	path := filepath.Join(t.TempDir(), "locust.yaml")
+	if err := ioutil.WriteFile(path, []byte(validateBase+conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "LOCUST_CONFIG="+path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stderr.String(), err
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  string
+		fatal string // part of the log if the configuration is refused
+	}{
+		{"run id", `
+cache :
+  run_id : run1
+`, ""},
+		{"run id with colon", `
+cache :
+  run_id : run:1
+`, "invalid run id"},
+		{"run id with slash", `
+cache :
+  run_id : run/1
+`, "invalid run id"},
+		{"tag count", `
+ops :
+  put_object :
+    tags :
+      count : 10
+`, ""},
+		{"too many tags", `
+ops :
+  put_object :
+    tags :
+      count : 11
+`, "invalid tag count"},
+		{"too many tags of object tagging", `
+ops :
+  object_tagging :
+    count : 11
+`, "invalid tag count"},
+		{"tag size", `
+ops :
+  object_tagging :
+    size : 257
+`, "invalid tag size"},
+		{"metadata", `
+ops :
+  put_object :
+    metadata :
+      count : 2
+      size : 1000
+`, ""},
+		{"too much metadata", `
+ops :
+  put_object :
+    metadata :
+      count : 2
+      size : 1100
+`, "invalid metadata"},
+		{"part size", `
+ops :
+  put_object :
+    multipart :
+      part_size : 5242880
+`, ""},
+		{"small part size", `
+ops :
+  put_object :
+    multipart :
+      part_size : 1048576
+`, "part_size should be at least 5MiB"},
+		{"scenario", `
+ops :
+  scenarios :
+    - name : flow
+      weight : 1
+      steps :
+        - op : put
+        - op : copy
+        - op : delete
+`, ""},
+		{"put after first step", `
+ops :
+  scenarios :
+    - name : flow
+      weight : 1
+      steps :
+        - op : head
+        - op : put
+`, "put could only be the first step"},
+		{"delete before last step", `
+data :
+  cache_result : True
+ops :
+  scenarios :
+    - name : flow
+      weight : 1
+      steps :
+        - op : delete
+        - op : head
+`, "delete could only be the last step"},
+		{"scenario without put or cache", `
+ops :
+  scenarios :
+    - name : flow
+      weight : 1
+      steps :
+        - op : get
+`, "needs cache_result"},
+		{"scenario names", `
+ops :
+  scenarios :
+    - name : flow
+      weight : 1
+      steps :
+        - op : put
+    - name : flow
+      weight : 1
+      steps :
+        - op : put
+`, "needs a unique name"},
+		{"negative throttle", `
+ops :
+  throttle :
+    upload :
+      per_request : -1
+`, "invalid throttle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log, err := loadConf(t, tt.conf)
+			switch {
+			case tt.fatal == "" && err != nil:
+				t.Errorf("valid configuration is refused with %v: %s", err, log)
+			case tt.fatal != "" && err == nil:
+				t.Errorf("invalid configuration is accepted, expect %q", tt.fatal)
+			case tt.fatal != "" && !strings.Contains(log, tt.fatal):
+				t.Errorf("invalid configuration is refused with %s, expect %q", log, tt.fatal)
+			}
+		})
+	}
+}
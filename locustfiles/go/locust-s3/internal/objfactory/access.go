@@ -0,0 +1,95 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/randstr"
+)
+
+// pickRank returns the rank of the object to read out of n objects, ordered from the
+// earliest written to the latest written. catalogs keep objects in about insertion order,
+// so a rank maps to a position of the catalog.
+var pickRank func(n int64) int64
+
+func init() {
+	access := config.LoadConf.Data.Access
+	switch access.Distribution {
+	case config.AccessZipf:
+		z := &zipfPicker{s: access.ZipfExponent, r: randstr.Default}
+		pickRank = z.pick
+	case config.AccessHotspot:
+		pickRank = hotspotPicker(access.HotSet/100, access.HotAccess/100)
+	case config.AccessRecent:
+		pickRank = recentPicker(access.RecentMeanAge)
+	default:
+		pickRank = uniformPick
+	}
+}
+
+func uniformPick(n int64) int64 {
+	return randstr.Default.Int63n(n)
+}
+
+// zipfPicker makes the earliest written objects the most popular ones, so the popular
+// set stays the same as more objects are written
+type zipfPicker struct {
+	s float64
+
+	sync.Mutex
+	r    *rand.Rand
+	n    int64
+	zipf *rand.Zipf
+}
+
+func (z *zipfPicker) pick(n int64) int64 {
+	z.Lock()
+	defer z.Unlock()
+	if n != z.n {
+		z.zipf = rand.NewZipf(z.r, z.s, 1, uint64(n-1))
+		z.n = n
+	}
+	return int64(z.zipf.Uint64())
+}
+
+// hotspotPicker reads the earliest hotSet fraction of objects with hotAccess probability,
+// and the rest of objects otherwise
+func hotspotPicker(hotSet, hotAccess float64) func(n int64) int64 {
+	return func(n int64) int64 {
+		hot := int64(float64(n) * hotSet)
+		if hot == 0 {
+			hot = 1
+		}
+		if randstr.Default.Float64() < hotAccess || hot == n {
+			return randstr.Default.Int63n(hot)
+		}
+		return hot + randstr.Default.Int63n(n-hot)
+	}
+}
+
+// recentPicker prefers recently written objects. age of the picked object, in number of
+// objects written after it, follows an exponential distribution with meanAge.
+func recentPicker(meanAge float64) func(n int64) int64 {
+	return func(n int64) int64 {
+		age := int64(math.Min(randstr.Default.ExpFloat64()*meanAge, float64(n-1)))
+		return n - 1 - age
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestPickers(t *testing.T) {
+	const n, picks = 1000, 20000
+	tests := []struct {
+		name string
+		pick func(n int64) int64
+		// fraction of picks expected among the earliest and the latest tenth of objects
+		earliest, latest float64
+	}{
+		{"uniform", uniformPick, 0.1, 0.1},
+		{"zipf", (&zipfPicker{s: 1.2, r: rand.New(rand.NewSource(1))}).pick, 0.83, 0.006},
+		{"hotspot", hotspotPicker(0.1, 0.9), 0.9, 0.1 / 9},
+		{"recent", recentPicker(20), 0, 0.993},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, size := range []int64{1, 2} {
+				if r := tt.pick(size); r < 0 || r >= size {
+					t.Fatalf("picked %d of %d objects", r, size)
+				}
+			}
+			var earliest, latest int
+			for i := 0; i < picks; i++ {
+				r := tt.pick(n)
+				switch {
+				case r < 0 || r >= n:
+					t.Fatalf("picked %d of %d objects", r, n)
+				case r < n/10:
+					earliest++
+				case r >= n-n/10:
+					latest++
+				}
+			}
+			for _, f := range []struct {
+				name        string
+				got, expect float64
+			}{
+				{"earliest", float64(earliest) / picks, tt.earliest},
+				{"latest", float64(latest) / picks, tt.latest},
+			} {
+				if f.got < f.expect-0.05 || f.got > f.expect+0.05 {
+					t.Errorf("%.3f of picks are among the %s objects, expect %.3f", f.got, f.name, f.expect)
+				}
+			}
+		})
+	}
+}
+
+func TestInsertionOrder(t *testing.T) {
+	var o insertionOrder
+	const n = 3000
+	for id := uint64(1); id <= n; id++ {
+		o.insert(id, orderWritable)
+	}
+	// every third object is removed, the others are claimed, read-only or writable
+	expectPicks, expectClaims := []uint64{}, []uint64{}
+	for id := uint64(1); id <= n; id++ {
+		switch id % 3 {
+		case 0:
+			o.set(id, orderRemoved)
+		case 1:
+			if id%2 == 0 {
+				o.set(id, orderClaimed)
+			} else {
+				o.set(id, orderReadOnly)
+				expectPicks = append(expectPicks, id)
+			}
+		default:
+			expectPicks = append(expectPicks, id)
+			expectClaims = append(expectClaims, id)
+		}
+	}
+	o.insert(n+1, orderWritable)
+	expectPicks, expectClaims = append(expectPicks, n+1), append(expectClaims, n+1)
+	for _, tt := range []struct {
+		name   string
+		find   func(rank func(n int64) int64) (uint64, bool)
+		expect []uint64
+	}{
+		{"pick", o.pick, expectPicks},
+		{"claim", o.claim, expectClaims},
+	} {
+		for i, id := range tt.expect {
+			rank := int64(i)
+			got, ok := tt.find(func(total int64) int64 {
+				if total != int64(len(tt.expect)) {
+					t.Fatalf("%s among %d objects, expect %d", tt.name, total, len(tt.expect))
+				}
+				return rank
+			})
+			if !ok || got != id {
+				t.Fatalf("%s of rank %d is %d, expect %d", tt.name, rank, got, id)
+			}
+		}
+	}
+}
+
+func TestInsertionOrderCompact(t *testing.T) {
+	var o insertionOrder
+	const n = 3000
+	for id := uint64(1); id <= n; id++ {
+		o.insert(id, orderWritable)
+	}
+	for id := uint64(1); id <= n; id++ {
+		if id%100 != 0 {
+			o.set(id, orderRemoved)
+		}
+	}
+	if len(o.ids) == n {
+		t.Fatalf("removed ids are not dropped")
+	}
+	var ids []uint64
+	o.each(func(id uint64, state uint8) { ids = append(ids, id) })
+	if len(ids) != n/100 || o.picks.total != n/100 || o.claims.total != n/100 {
+		t.Fatalf("%d ids are left, %d to pick and %d to claim", len(ids), o.picks.total, o.claims.total)
+	}
+	for i, id := range ids {
+		rank := int64(i)
+		if got, _ := o.pick(func(int64) int64 { return rank }); id != uint64(i+1)*100 || got != id {
+			t.Fatalf("pick of rank %d is %d, expect %d", rank, got, (i+1)*100)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+)
+
+// Catalog keeps track of objects written by locust, so they could be read or deleted later
+type Catalog interface {
+	// Add records an object. an object of the same bucket and key replaces the recorded one,
+	// even a claimed one, so an object written again is never recorded twice.
+	Add(o *ObjectSpec) error
+	// RandomPick fills o with a random recorded object
+	RandomPick(o *ObjectSpec) error
+	// PickWritable fills o with a random object which is not read-only, to change its
+	// tags or ACL. it is not claimed.
+	PickWritable(o *ObjectSpec) error
+	// Remove forgets an object
+	Remove(o *ObjectSpec) error
+	// Count returns number of recorded objects
+	Count() (int64, error)
+	// ForEach calls fn with every recorded object, claimed ones included, until fn returns an error
+	ForEach(fn func(o *ObjectSpec) error) error
+
+	// Claim fills o with a random object and takes it out of random picks, so it is
+	// deleted by only one user and not read while being deleted. read-only objects are
+	// never claimed.
+	Claim(o *ObjectSpec) error
+	// Confirm forgets a claimed object after it is deleted
+	Confirm(o *ObjectSpec) error
+	// Release puts a claimed object back to random picks after delete failed
+	Release(o *ObjectSpec) error
+	// ReleaseAll puts every claimed object back no matter how long it is claimed, e.g. by a
+	// runner which died, so a run being torn down could claim them again
+	ReleaseAll() error
+}
+
+// RunInfo summarizes objects recorded by a run
+type RunInfo struct {
+	ID      string
+	Objects int64
+	Bytes   int64
+}
+
+// RunCatalog is a catalog shared by many runs, with each run recorded separately
+type RunCatalog interface {
+	// Runs lists all runs in the catalog
+	Runs() ([]RunInfo, error)
+	// DropRun forgets all objects recorded by a run
+	DropRun(id string) error
+}
+
+// BucketCatalog records buckets created by a run, so cleanup only removes buckets the run
+// created, not ones which existed before
+type BucketCatalog interface {
+	// AddBucket records a bucket created by the run
+	AddBucket(name string) error
+	// Buckets lists buckets created by the run
+	Buckets() ([]string, error)
+	// RemoveBucket forgets a bucket once it is removed
+	RemoveBucket(name string) error
+}
+
+// SharedDataset is a catalog shared by runners, which reserves room of a dataset target
+// atomically, so runners preparing one dataset together stop at the target
+type SharedDataset interface {
+	// Reserve takes room of one object of size, and returns the reservation, or an empty one
+	// once objects recorded and reserved by all runners reach the target. a target of 0 has
+	// no limit.
+	Reserve(size, targetObjects, targetBytes int64) (string, error)
+	// Unreserve gives room of a reservation back, once its upload failed or before it is added
+	Unreserve(reservation string) error
+}
+
+// ErrEmptyCatalog is returned when there is no object to pick
+var ErrEmptyCatalog = errors.New("no key from cache")
+
+var catalog Catalog
+
+func init() {
+	if !config.LoadConf.Data.CacheResult {
+		return
+	}
+	switch config.LoadConf.Cache.Type {
+	case config.CacheRedis:
+		catalog = newRedisCatalog()
+	case config.CacheMemory:
+		catalog = newMemoryCatalog()
+	case config.CacheDisk:
+		catalog = newDiskCatalog()
+	default:
+		log.Fatalf("unsupported cache type %s", config.LoadConf.Cache.Type)
+	}
+}
+
+// ObjectCatalog returns the configured catalog, or nil if cache_result is not enabled
+func ObjectCatalog() Catalog {
+	return catalog
+}
+
+// objectID identifies an object in catalog
+func objectID(o *ObjectSpec) string {
+	return o.ObjectBucket + "/" + o.ObjectKey
+}
+
+// catalog entry field names. they are short to keep large catalogs small.
+const (
+	fieldBucket      = "b"
+	fieldKey         = "k"
+	fieldSize        = "s"
+	fieldSSECKey     = "c"
+	fieldETag        = "e"
+	fieldModified    = "m"
+	fieldVersion     = "v"
+	fieldRetainUntil = "r"
+	fieldLegalHold   = "h"
+	fieldPayloadOf   = "g"
+	fieldReadOnly    = "o"
+	fieldGeneration  = "n"
+)
+
+// catalogEntry returns fields of the object which are kept in catalog
+func (o *ObjectSpec) catalogEntry() map[string]string {
+	e := map[string]string{
+		fieldBucket: o.ObjectBucket,
+		fieldKey:    o.ObjectKey,
+		fieldSize:   strconv.FormatInt(o.ObjectSize, 10),
+	}
+	if o.SSECustomerKey != "" {
+		e[fieldSSECKey] = base64.StdEncoding.EncodeToString([]byte(o.SSECustomerKey))
+	}
+	if o.ETag != "" {
+		e[fieldETag] = o.ETag
+		e[fieldModified] = strconv.FormatInt(o.LastModified.Unix(), 10)
+	}
+	if o.VersionID != "" {
+		e[fieldVersion] = o.VersionID
+	}
+	if !o.RetainUntil.IsZero() {
+		e[fieldRetainUntil] = strconv.FormatInt(o.RetainUntil.Unix(), 10)
+	}
+	if o.LegalHold {
+		e[fieldLegalHold] = "1"
+	}
+	if o.PayloadOf != "" {
+		e[fieldPayloadOf] = o.PayloadOf
+	}
+	if o.ReadOnly {
+		e[fieldReadOnly] = "1"
+	}
+	if o.Generation != 0 {
+		e[fieldGeneration] = strconv.FormatInt(o.Generation, 10)
+	}
+	return e
+}
+
+// setCatalogEntry fills the object with fields from catalog. only bucket and key are mandatory,
+// other fields are left empty if missing or malformed.
+func (o *ObjectSpec) setCatalogEntry(e map[string]string) error {
+	o.ObjectBucket, o.ObjectKey = e[fieldBucket], e[fieldKey]
+	if o.ObjectBucket == "" || o.ObjectKey == "" {
+		return fmt.Errorf("catalog entry without bucket or key %v", e)
+	}
+	o.ObjectSize, _ = strconv.ParseInt(e[fieldSize], 10, 64)
+	o.SSECustomerKey = ""
+	if c, ok := e[fieldSSECKey]; ok {
+		key, err := base64.StdEncoding.DecodeString(c)
+		if err != nil {
+			return fmt.Errorf("invalid SSE-C key of %s in cache", o.ObjectKey)
+		}
+		o.SSECustomerKey = string(key)
+	}
+	o.ETag = e[fieldETag]
+	o.LastModified = parseUnixTime(e[fieldModified])
+	o.VersionID = e[fieldVersion]
+	o.RetainUntil = parseUnixTime(e[fieldRetainUntil])
+	_, o.LegalHold = e[fieldLegalHold]
+	o.PayloadOf = e[fieldPayloadOf]
+	_, o.ReadOnly = e[fieldReadOnly]
+	o.Generation, _ = strconv.ParseInt(e[fieldGeneration], 10, 64)
+	return nil
+}
+
+func parseUnixTime(s string) time.Time {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0)
+	}
+	return time.Time{}
+}
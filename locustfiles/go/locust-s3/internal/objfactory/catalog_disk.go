@@ -0,0 +1,525 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+// diskCatalog keeps objects in a single BoltDB file, so the catalog survives restart of
+// the runner and is never evicted like redis keys could be under memory pressure.
+//
+// each run has its own top level bucket. inside it, each object gets an increasing sequence
+// id. entries are stored by id, and an index maps bucket/key back to the id. claimed objects
+// are moved to a pending bucket with the same id, read-only objects are kept in a bucket of
+// their own, and names of S3 buckets created by the run in another one. the file belongs to
+// one runner, so objects still pending when the runner starts are put back, and ids are kept
+// in memory in insertion order to pick them by rank. the order is updated once a transaction
+// commits, so it could briefly hold an id gone from the file, which is dropped once picked.
+type diskCatalog struct {
+	db  *bolt.DB
+	run []byte
+
+	sync.Mutex
+	order insertionOrder
+}
+
+var (
+	diskObjectsBucket  = []byte("objects")
+	diskIndexBucket    = []byte("index")
+	diskPendingBucket  = []byte("pending")
+	diskReadOnlyBucket = []byte("readonly")
+	diskMetaBucket     = []byte("meta")
+	diskBucketsBucket  = []byte("buckets")
+	diskCountKey       = []byte("count")
+	diskBytesKey       = []byte("bytes")
+)
+
+// diskRun holds buckets of a run inside a transaction
+type diskRun struct {
+	objects, index, pending, meta, readOnly *bolt.Bucket
+}
+
+// state returns the state in insertionOrder of id
+func (r diskRun) state(id []byte) uint8 {
+	switch {
+	case r.objects.Get(id) != nil:
+		return orderWritable
+	case r.readOnly.Get(id) != nil:
+		return orderReadOnly
+	case r.pending.Get(id) != nil:
+		return orderClaimed
+	}
+	return orderRemoved
+}
+
+// holding returns the bucket which holds id, or nil if none does
+func (r diskRun) holding(id []byte) *bolt.Bucket {
+	for _, b := range []*bolt.Bucket{r.objects, r.pending, r.readOnly} {
+		if b.Get(id) != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+func newDiskCatalog() *diskCatalog {
+	db, err := bolt.Open(config.LoadConf.Cache.Path, 0644, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		log.Fatalf("failed to open catalog file %s with %s\n", config.LoadConf.Cache.Path, err.Error())
+	}
+	c := &diskCatalog{db: db, run: []byte(config.LoadConf.Cache.RunID)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(c.run)
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{diskObjectsBucket, diskIndexBucket, diskPendingBucket, diskMetaBucket, diskReadOnlyBucket, diskBucketsBucket} {
+			if _, err := root.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		// claims left by a previous run of the runner
+		r := c.buckets(tx)
+		if _, err := releasePending(r); err != nil {
+			return err
+		}
+		c.loadOrder(r)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("failed to initialize catalog file %s with %s\n", config.LoadConf.Cache.Path, err.Error())
+	}
+	return c
+}
+
+// releasePending moves all claimed objects back, and returns their ids
+func releasePending(r diskRun) ([]uint64, error) {
+	var ids []uint64
+	cursor := r.pending.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.First() {
+		if err := r.objects.Put(k, v); err != nil {
+			return nil, err
+		}
+		ids = append(ids, binary.BigEndian.Uint64(k))
+		if err := cursor.Delete(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// loadOrder reads ids of objects and read-only objects in insertion order
+func (c *diskCatalog) loadOrder(r diskRun) {
+	objects, readOnly := r.objects.Cursor(), r.readOnly.Cursor()
+	ko, _ := objects.First()
+	kr, _ := readOnly.First()
+	for ko != nil || kr != nil {
+		if kr == nil || (ko != nil && bytes.Compare(ko, kr) < 0) {
+			c.order.insert(binary.BigEndian.Uint64(ko), orderWritable)
+			ko, _ = objects.Next()
+		} else {
+			c.order.insert(binary.BigEndian.Uint64(kr), orderReadOnly)
+			kr, _ = readOnly.Next()
+		}
+	}
+}
+
+func (c *diskCatalog) buckets(tx *bolt.Tx) diskRun {
+	root := tx.Bucket(c.run)
+	return diskRun{
+		objects:  root.Bucket(diskObjectsBucket),
+		index:    root.Bucket(diskIndexBucket),
+		pending:  root.Bucket(diskPendingBucket),
+		meta:     root.Bucket(diskMetaBucket),
+		readOnly: root.Bucket(diskReadOnlyBucket),
+	}
+}
+
+func diskID(seq uint64) []byte {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, seq)
+	return id
+}
+
+func diskCounter(meta *bolt.Bucket, key []byte) int64 {
+	if v := meta.Get(key); v != nil {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+// addStats adjusts number of objects and bytes of the run, so they are known without
+// walking the whole file
+func addStats(meta *bolt.Bucket, objects, bytes int64) error {
+	if err := meta.Put(diskCountKey, diskID(uint64(diskCounter(meta, diskCountKey)+objects))); err != nil {
+		return err
+	}
+	return meta.Put(diskBytesKey, diskID(uint64(diskCounter(meta, diskBytesKey)+bytes)))
+}
+
+// entrySize returns the object size of a stored entry
+func entrySize(v []byte) int64 {
+	var e map[string]string
+	if json.Unmarshal(v, &e) != nil {
+		return 0
+	}
+	size, _ := strconv.ParseInt(e[fieldSize], 10, 64)
+	return size
+}
+
+func (c *diskCatalog) Add(o *ObjectSpec) error {
+	value, err := json.Marshal(o.catalogEntry())
+	if err != nil {
+		return err
+	}
+	name := []byte(objectID(o))
+	var added uint64
+	var state uint8
+	// batch coalesces concurrent adds of all virtual users into fewer disk syncs
+	err = c.db.Batch(func(tx *bolt.Tx) error {
+		r := c.buckets(tx)
+		bucket := r.objects
+		state = orderWritable
+		if o.ReadOnly {
+			bucket, state = r.readOnly, orderReadOnly
+		}
+		if id := r.index.Get(name); id != nil {
+			id = append([]byte(nil), id...)
+			added = binary.BigEndian.Uint64(id)
+			old := r.holding(id)
+			var size int64
+			if old != nil {
+				size = entrySize(old.Get(id))
+			}
+			// a claimed object stays claimed, otherwise it moves if it becomes read-only or not
+			if old == r.pending {
+				bucket, state = r.pending, orderClaimed
+			} else if old != nil && old != bucket {
+				if err := old.Delete(id); err != nil {
+					return err
+				}
+			}
+			if err := bucket.Put(id, value); err != nil {
+				return err
+			}
+			return addStats(r.meta, 0, o.ObjectSize-size)
+		}
+		seq, err := r.objects.NextSequence()
+		if err != nil {
+			return err
+		}
+		added = seq
+		id := diskID(seq)
+		if err := bucket.Put(id, value); err != nil {
+			return err
+		}
+		if err := r.index.Put(name, id); err != nil {
+			return err
+		}
+		return addStats(r.meta, 1, o.ObjectSize)
+	})
+	if err == nil {
+		c.Lock()
+		c.order.insert(added, state)
+		c.Unlock()
+	}
+	return err
+}
+
+// entryOf returns an entry of the objects or read-only bucket by id, or nil if neither holds it
+func entryOf(r diskRun, id []byte) (map[string]string, error) {
+	v := r.objects.Get(id)
+	if v == nil {
+		v = r.readOnly.Get(id)
+	}
+	if v == nil {
+		return nil, nil
+	}
+	var e map[string]string
+	err := json.Unmarshal(v, &e)
+	return e, err
+}
+
+func (c *diskCatalog) RandomPick(o *ObjectSpec) error {
+	return c.randomPick(o, false)
+}
+
+func (c *diskCatalog) PickWritable(o *ObjectSpec) error {
+	return c.randomPick(o, true)
+}
+
+// randomPick picks out of all objects, or only out of writable ones, which are the ones that
+// could be claimed
+func (c *diskCatalog) randomPick(o *ObjectSpec, writable bool) error {
+	for {
+		var id uint64
+		var ok bool
+		c.Lock()
+		if writable {
+			id, ok = c.order.claim(pickRank)
+		} else {
+			id, ok = c.order.pick(pickRank)
+		}
+		c.Unlock()
+		if !ok {
+			return ErrEmptyCatalog
+		}
+		var e map[string]string
+		state := orderWritable
+		err := c.db.View(func(tx *bolt.Tx) error {
+			r := c.buckets(tx)
+			var err error
+			if e, err = entryOf(r, diskID(id)); err == nil && e == nil {
+				state = r.state(diskID(id))
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if e != nil && (!writable || entryState(e) == orderWritable) {
+			return o.setCatalogEntry(e)
+		}
+		if e != nil {
+			state = entryState(e)
+		}
+		c.Lock()
+		c.order.set(id, state)
+		c.Unlock()
+	}
+}
+
+func (c *diskCatalog) Remove(o *ObjectSpec) error {
+	name := []byte(objectID(o))
+	var removed uint64
+	err := c.db.Batch(func(tx *bolt.Tx) error {
+		removed = 0
+		r := c.buckets(tx)
+		id := r.index.Get(name)
+		if id == nil {
+			return nil
+		}
+		// bolt values are only valid during the transaction
+		id = append([]byte(nil), id...)
+		var size int64
+		if b := r.holding(id); b != nil {
+			size = entrySize(b.Get(id))
+			if err := b.Delete(id); err != nil {
+				return err
+			}
+		}
+		if err := r.index.Delete(name); err != nil {
+			return err
+		}
+		removed = binary.BigEndian.Uint64(id)
+		return addStats(r.meta, -1, -size)
+	})
+	if err == nil && removed != 0 {
+		c.Lock()
+		c.order.set(removed, orderRemoved)
+		c.Unlock()
+	}
+	return err
+}
+
+func (c *diskCatalog) Count() (count int64, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		count = diskCounter(c.buckets(tx).meta, diskCountKey)
+		return nil
+	})
+	return
+}
+
+func (c *diskCatalog) ForEach(fn func(o *ObjectSpec) error) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		r := c.buckets(tx)
+		for _, b := range []*bolt.Bucket{r.readOnly, r.objects, r.pending} {
+			err := b.ForEach(func(k, v []byte) error {
+				var e map[string]string
+				if err := json.Unmarshal(v, &e); err != nil {
+					return err
+				}
+				var o ObjectSpec
+				if err := o.setCatalogEntry(e); err != nil {
+					return err
+				}
+				return fn(&o)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *diskCatalog) Claim(o *ObjectSpec) error {
+	for {
+		// the id is claimed in the order first, so no one else claims it meanwhile
+		c.Lock()
+		id, ok := c.order.claim(uniformPick)
+		if ok {
+			c.order.set(id, orderClaimed)
+		}
+		c.Unlock()
+		if !ok {
+			return ErrEmptyCatalog
+		}
+		state := orderClaimed
+		err := c.db.Batch(func(tx *bolt.Tx) error {
+			r := c.buckets(tx)
+			k := diskID(id)
+			v := r.objects.Get(k)
+			if v == nil {
+				state = r.state(k)
+				return nil
+			}
+			state = orderClaimed
+			v = append([]byte(nil), v...)
+			var e map[string]string
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if err := o.setCatalogEntry(e); err != nil {
+				return err
+			}
+			if err := r.pending.Put(k, v); err != nil {
+				return err
+			}
+			return r.objects.Delete(k)
+		})
+		if err != nil {
+			state = orderWritable
+		}
+		if state != orderClaimed {
+			c.Lock()
+			c.order.set(id, state)
+			c.Unlock()
+		}
+		if err != nil || state == orderClaimed {
+			return err
+		}
+	}
+}
+
+func (c *diskCatalog) Confirm(o *ObjectSpec) error {
+	return c.Remove(o)
+}
+
+func (c *diskCatalog) Release(o *ObjectSpec) error {
+	name := []byte(objectID(o))
+	var released uint64
+	err := c.db.Batch(func(tx *bolt.Tx) error {
+		released = 0
+		r := c.buckets(tx)
+		id := r.index.Get(name)
+		if id == nil {
+			return nil
+		}
+		v := r.pending.Get(id)
+		if v == nil {
+			return nil
+		}
+		if err := r.objects.Put(id, v); err != nil {
+			return err
+		}
+		released = binary.BigEndian.Uint64(id)
+		return r.pending.Delete(id)
+	})
+	if err == nil && released != 0 {
+		// a released object goes back to its place
+		c.Lock()
+		c.order.set(released, orderWritable)
+		c.Unlock()
+	}
+	return err
+}
+
+func (c *diskCatalog) ReleaseAll() error {
+	var released []uint64
+	err := c.db.Update(func(tx *bolt.Tx) (err error) {
+		released, err = releasePending(c.buckets(tx))
+		return err
+	})
+	if err == nil {
+		c.Lock()
+		for _, id := range released {
+			c.order.set(id, orderWritable)
+		}
+		c.Unlock()
+	}
+	return err
+}
+
+func (c *diskCatalog) AddBucket(name string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.run).Bucket(diskBucketsBucket).Put([]byte(name), []byte{})
+	})
+}
+
+func (c *diskCatalog) Buckets() (names []string, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.run).Bucket(diskBucketsBucket).ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return
+}
+
+func (c *diskCatalog) RemoveBucket(name string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.run).Bucket(diskBucketsBucket).Delete([]byte(name))
+	})
+}
+
+func (c *diskCatalog) Runs() (runs []RunInfo, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, root *bolt.Bucket) error {
+			meta := root.Bucket(diskMetaBucket)
+			if meta == nil {
+				return nil
+			}
+			runs = append(runs, RunInfo{
+				ID:      string(name),
+				Objects: diskCounter(meta, diskCountKey),
+				Bytes:   diskCounter(meta, diskBytesKey),
+			})
+			return nil
+		})
+	})
+	return
+}
+
+func (c *diskCatalog) DropRun(id string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(id)) == nil {
+			return nil
+		}
+		return tx.DeleteBucket([]byte(id))
+	})
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"sync"
+)
+
+// memoryCatalog keeps objects in process. it is good for a single runner without redis,
+// objects are lost when the runner exits. objects keep their insertion order while others
+// are removed, claimed or released, which access distributions depend on.
+type memoryCatalog struct {
+	sync.Mutex
+	entries map[uint64]map[string]string
+	index   map[string]uint64 // bucket/key to id of entries
+	order   insertionOrder
+	seq     uint64
+}
+
+func newMemoryCatalog() *memoryCatalog {
+	return &memoryCatalog{entries: make(map[uint64]map[string]string), index: make(map[string]uint64)}
+}
+
+func (c *memoryCatalog) Add(o *ObjectSpec) error {
+	c.Lock()
+	defer c.Unlock()
+	e := o.catalogEntry()
+	if id, ok := c.index[objectID(o)]; ok {
+		c.entries[id] = e
+		if c.order.state(id) != orderClaimed {
+			c.order.set(id, entryState(e))
+		}
+		return nil
+	}
+	c.seq++
+	c.entries[c.seq] = e
+	c.index[objectID(o)] = c.seq
+	c.order.insert(c.seq, entryState(e))
+	return nil
+}
+
+func (c *memoryCatalog) RandomPick(o *ObjectSpec) error {
+	c.Lock()
+	defer c.Unlock()
+	id, ok := c.order.pick(pickRank)
+	if !ok {
+		return ErrEmptyCatalog
+	}
+	return o.setCatalogEntry(c.entries[id])
+}
+
+func (c *memoryCatalog) PickWritable(o *ObjectSpec) error {
+	c.Lock()
+	defer c.Unlock()
+	// objects which could be claimed are the writable ones
+	id, ok := c.order.claim(pickRank)
+	if !ok {
+		return ErrEmptyCatalog
+	}
+	return o.setCatalogEntry(c.entries[id])
+}
+
+func (c *memoryCatalog) Remove(o *ObjectSpec) error {
+	c.Lock()
+	defer c.Unlock()
+	c.remove(objectID(o))
+	return nil
+}
+
+// remove forgets an object by bucket/key. it must be called with lock held.
+func (c *memoryCatalog) remove(name string) {
+	if id, ok := c.index[name]; ok {
+		c.order.set(id, orderRemoved)
+		delete(c.entries, id)
+		delete(c.index, name)
+	}
+}
+
+func (c *memoryCatalog) Claim(o *ObjectSpec) error {
+	c.Lock()
+	defer c.Unlock()
+	id, ok := c.order.claim(uniformPick)
+	if !ok {
+		return ErrEmptyCatalog
+	}
+	if err := o.setCatalogEntry(c.entries[id]); err != nil {
+		return err
+	}
+	c.order.set(id, orderClaimed)
+	return nil
+}
+
+func (c *memoryCatalog) Confirm(o *ObjectSpec) error {
+	c.Lock()
+	defer c.Unlock()
+	if id, ok := c.index[objectID(o)]; ok && c.order.state(id) == orderClaimed {
+		c.remove(objectID(o))
+	}
+	return nil
+}
+
+func (c *memoryCatalog) Release(o *ObjectSpec) error {
+	c.Lock()
+	defer c.Unlock()
+	// a released object goes back to its place
+	if id, ok := c.index[objectID(o)]; ok && c.order.state(id) == orderClaimed {
+		c.order.set(id, entryState(c.entries[id]))
+	}
+	return nil
+}
+
+func (c *memoryCatalog) ReleaseAll() error {
+	c.Lock()
+	defer c.Unlock()
+	var claimed []uint64
+	c.order.each(func(id uint64, state uint8) {
+		if state == orderClaimed {
+			claimed = append(claimed, id)
+		}
+	})
+	for _, id := range claimed {
+		c.order.set(id, entryState(c.entries[id]))
+	}
+	return nil
+}
+
+func (c *memoryCatalog) Count() (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+	return int64(len(c.index)), nil
+}
+
+func (c *memoryCatalog) ForEach(fn func(o *ObjectSpec) error) error {
+	// work on a snapshot so fn could modify the catalog
+	c.Lock()
+	var entries []map[string]string
+	c.order.each(func(id uint64, state uint8) {
+		entries = append(entries, c.entries[id])
+	})
+	c.Unlock()
+	for _, e := range entries {
+		var o ObjectSpec
+		if err := o.setCatalogEntry(e); err != nil {
+			return err
+		}
+		if err := fn(&o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
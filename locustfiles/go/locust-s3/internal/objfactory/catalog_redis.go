@@ -0,0 +1,558 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/randstr"
+)
+
+// redisCatalog keeps all keys under a namespace and run id, so it never picks up unrelated
+// keys of the same redis DB, nor objects of other runs.
+//
+//	<namespace>:runs                 set of run ids
+//	<namespace>:<run>:objects        sorted set of bucket/key, scored by insertion sequence
+//	<namespace>:<run>:readonly       sorted set of read-only bucket/key, scored by the same sequence
+//	<namespace>:<run>:seq            the insertion sequence
+//	<namespace>:<run>:obj:<id>       hash of catalog entry fields
+//	<namespace>:<run>:pending        sorted set of claimed bucket/key, scored by claim time
+//	<namespace>:<run>:claimed        hash of claimed bucket/key to its score in the sorted set
+//	<namespace>:<run>:stats          hash of number of objects and bytes of the run
+//	<namespace>:<run>:buckets        set of buckets created by the run
+//	<namespace>:<run>:reserved       sorted set of reservations of objects being prepared, scored by deadline
+//
+// random pick chooses random ranks of the sorted set, and fetches entries of a batch of
+// ranks with two pipelined round trips. ranks of read-only objects come before the others,
+// as they are imported before a run writes any. the rest of the batch is served from memory for a
+// short while, each one after checking it is still in the sorted set, so objects claimed
+// or removed since are not read. claimed objects whose lease expires, e.g. the runner died
+// in the middle of a delete, are put back by a reaper.
+type redisCatalog struct {
+	client  *redis.Client
+	ns      string
+	runsKey string
+	redisRunKeys
+	batch  int
+	lease  time.Duration
+	reaper sync.Once
+
+	reservations int64
+
+	sync.Mutex
+	picked   []map[string]string
+	pickedAt time.Time
+}
+
+// how long a fetched batch is used for random picks, so the picks follow the access distribution
+// of the current set of objects
+const pickedTTL = time.Second
+
+// redisRunKeys are the keys of one run
+type redisRunKeys struct {
+	objectsKey  string
+	readOnlyKey string
+	seqKey      string
+	entryPrefix string
+	pendingKey  string
+	claimedKey  string
+	statsKey    string
+	reservedKey string
+	bucketsKey  string
+}
+
+func newRedisRunKeys(ns, run string) redisRunKeys {
+	prefix := ns + ":" + run
+	return redisRunKeys{
+		objectsKey:  prefix + ":objects",
+		readOnlyKey: prefix + ":readonly",
+		seqKey:      prefix + ":seq",
+		entryPrefix: prefix + ":obj:",
+		pendingKey:  prefix + ":pending",
+		claimedKey:  prefix + ":claimed",
+		statsKey:    prefix + ":stats",
+		reservedKey: prefix + ":reserved",
+		bucketsKey:  prefix + ":buckets",
+	}
+}
+
+// stats hash fields
+const (
+	statsObjects = "objects"
+	statsBytes   = "bytes"
+)
+
+// addScript records an entry and adds it to the sorted set if it is new. a known object which
+// becomes read-only or not moves to the other sorted set in place. stats of the run are updated
+// with the size of the entry, and the run is registered.
+// KEYS: sequence, objects, entry, pending, stats, runs, readonly.
+// ARGV: object id, size, run id, 1 if read-only, then entry fields and values.
+var addScript = redis.NewScript(`
+local old = redis.call('HGET', KEYS[3], 's')
+redis.call('DEL', KEYS[3])
+redis.call('HMSET', KEYS[3], unpack(ARGV, 5))
+local set, other = KEYS[2], KEYS[7]
+if ARGV[4] == '1' then
+	set, other = KEYS[7], KEYS[2]
+end
+local score = redis.call('ZSCORE', other, ARGV[1])
+if score then
+	redis.call('ZREM', other, ARGV[1])
+	redis.call('ZADD', set, score, ARGV[1])
+end
+if not score and not redis.call('ZSCORE', set, ARGV[1]) and not redis.call('ZSCORE', KEYS[4], ARGV[1]) then
+	redis.call('ZADD', set, redis.call('INCR', KEYS[1]), ARGV[1])
+	redis.call('HINCRBY', KEYS[5], 'objects', 1)
+	redis.call('HINCRBY', KEYS[5], 'bytes', ARGV[2])
+else
+	redis.call('HINCRBY', KEYS[5], 'bytes', tonumber(ARGV[2]) - tonumber(old or '0'))
+end
+redis.call('SADD', KEYS[6], ARGV[3])
+return 1
+`)
+
+// removeScript forgets an object no matter it is claimed or not, and updates stats of the run.
+// KEYS: objects, pending, entry, stats, readonly, claimed. ARGV: object id.
+var removeScript = redis.NewScript(`
+local removed = redis.call('ZREM', KEYS[1], ARGV[1]) + redis.call('ZREM', KEYS[2], ARGV[1]) + redis.call('ZREM', KEYS[5], ARGV[1])
+if removed > 0 then
+	local size = tonumber(redis.call('HGET', KEYS[3], 's') or '0')
+	redis.call('HINCRBY', KEYS[4], 'objects', -1)
+	redis.call('HINCRBY', KEYS[4], 'bytes', -size)
+end
+redis.call('DEL', KEYS[3])
+redis.call('HDEL', KEYS[6], ARGV[1])
+return removed
+`)
+
+// claimScript moves the object at a random rank from the sorted set to pending, keeping its
+// score to put it back in place, and returns its id followed by entry fields and values.
+// redis scripts have no real random, so the rank is given as a fraction of the set size.
+// KEYS: objects, pending, claimed. ARGV: rank fraction, claim time, entry key prefix.
+var claimScript = redis.NewScript(`
+local n = redis.call('ZCARD', KEYS[1])
+if n == 0 then
+	return {}
+end
+local rank = math.floor(tonumber(ARGV[1]) * n)
+local id = redis.call('ZRANGE', KEYS[1], rank, rank)[1]
+redis.call('HSET', KEYS[3], id, redis.call('ZSCORE', KEYS[1], id))
+redis.call('ZREM', KEYS[1], id)
+redis.call('ZADD', KEYS[2], ARGV[2], id)
+local result = redis.call('HGETALL', ARGV[3] .. id)
+table.insert(result, 1, id)
+return result
+`)
+
+// releaseScript moves a claimed object back to its place in the sorted set, so its rank
+// does not change as in the other catalogs. a claim without a kept score is added as new.
+// KEYS: sequence, objects, pending, claimed. ARGV: object id.
+var releaseScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[3], ARGV[1]) == 1 then
+	local score = redis.call('HGET', KEYS[4], ARGV[1]) or redis.call('INCR', KEYS[1])
+	redis.call('ZADD', KEYS[2], score, ARGV[1])
+end
+redis.call('HDEL', KEYS[4], ARGV[1])
+return 1
+`)
+
+// reserveScript takes room of an object if recorded and reserved objects and bytes are below
+// the target. every reservation is a member of its own, named <runner>:<n>:<size> and scored by
+// its deadline, so reservations of a runner which died expire with the lease while others go on.
+// KEYS: stats, reserved. ARGV: reservation, target objects, target bytes, now and lease in milliseconds.
+var reserveScript = redis.NewScript(`
+local now = tonumber(ARGV[4])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+local objects = tonumber(redis.call('HGET', KEYS[1], 'objects') or '0')
+local bytes = tonumber(redis.call('HGET', KEYS[1], 'bytes') or '0')
+for _, reservation in ipairs(redis.call('ZRANGE', KEYS[2], 0, -1)) do
+	objects = objects + 1
+	bytes = bytes + tonumber(string.match(reservation, ':(%d+)$'))
+end
+local targetObjects, targetBytes = tonumber(ARGV[2]), tonumber(ARGV[3])
+if (targetObjects > 0 and objects >= targetObjects) or (targetBytes > 0 and bytes >= targetBytes) then
+	return 0
+end
+redis.call('ZADD', KEYS[2], now + tonumber(ARGV[5]), ARGV[1])
+redis.call('PEXPIRE', KEYS[2], ARGV[5])
+return 1
+`)
+
+func newRedisCatalog() *redisCatalog {
+	address := fmt.Sprintf("%s:%s", config.LoadConf.Cache.Server, config.LoadConf.Cache.Port)
+	db, _ := strconv.ParseInt(config.LoadConf.Cache.Db, 0, 0)
+	client := redis.NewClient(&redis.Options{
+		Addr:     address,
+		Password: "",
+		DB:       int(db),
+	})
+	if _, err := client.Ping().Result(); err != nil {
+		log.Fatalf("failed to connect to redis with %s\n", err.Error())
+	}
+	ns := config.LoadConf.Cache.Namespace
+	return &redisCatalog{
+		client:       client,
+		ns:           ns,
+		runsKey:      ns + ":runs",
+		redisRunKeys: newRedisRunKeys(ns, config.LoadConf.Cache.RunID),
+		batch:        config.LoadConf.Cache.PickBatch,
+		lease:        config.LoadConf.Cache.Lease,
+	}
+}
+
+func (c *redisCatalog) Add(o *ObjectSpec) error {
+	id := objectID(o)
+	readOnly := 0
+	if o.ReadOnly {
+		readOnly = 1
+	}
+	args := []interface{}{id, o.ObjectSize, config.LoadConf.Cache.RunID, readOnly}
+	for field, value := range o.catalogEntry() {
+		args = append(args, field, value)
+	}
+	keys := []string{c.seqKey, c.objectsKey, c.entryPrefix + id, c.pendingKey, c.statsKey, c.runsKey, c.readOnlyKey}
+	return addScript.Run(c.client, keys, args...).Err()
+}
+
+// fetch reads entries of up to n random objects, or only of writable ones. entries which are
+// gone, e.g. evicted by redis, are dropped from the sorted set.
+func (c *redisCatalog) fetch(n int, writable bool) ([]map[string]string, error) {
+	pipe := c.client.Pipeline()
+	readOnlyCard, objects := pipe.ZCard(c.readOnlyKey), pipe.ZCard(c.objectsKey)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	readOnly := readOnlyCard.Val()
+	if writable {
+		readOnly = 0
+	}
+	count := readOnly + objects.Val()
+	if count == 0 {
+		return nil, ErrEmptyCatalog
+	}
+
+	pipe = c.client.Pipeline()
+	ranks := make([]*redis.StringSliceCmd, n)
+	for i := range ranks {
+		r := pickRank(count)
+		if r < readOnly {
+			ranks[i] = pipe.ZRange(c.readOnlyKey, r, r)
+		} else {
+			r -= readOnly
+			ranks[i] = pipe.ZRange(c.objectsKey, r, r)
+		}
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, cmd := range ranks {
+		// rank could be out of range if objects are removed in between
+		ids = append(ids, cmd.Val()...)
+	}
+	if len(ids) == 0 {
+		return nil, ErrEmptyCatalog
+	}
+	pipe = c.client.Pipeline()
+	entries := make([]*redis.StringStringMapCmd, len(ids))
+	for i, id := range ids {
+		entries[i] = pipe.HGetAll(c.entryPrefix + id)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	var result []map[string]string
+	for i, cmd := range entries {
+		e := cmd.Val()
+		if len(e) == 0 {
+			removeScript.Run(c.client, c.removeKeys(ids[i]), ids[i])
+			continue
+		}
+		var o ObjectSpec
+		if o.setCatalogEntry(e) != nil {
+			continue
+		}
+		result = append(result, e)
+	}
+	if len(result) == 0 {
+		return nil, ErrEmptyCatalog
+	}
+	return result, nil
+}
+
+func (c *redisCatalog) RandomPick(o *ObjectSpec) error {
+	for {
+		c.Lock()
+		if time.Since(c.pickedAt) > pickedTTL {
+			c.picked = nil
+		}
+		n := len(c.picked)
+		if n == 0 {
+			c.Unlock()
+			break
+		}
+		e := c.picked[n-1]
+		c.picked = c.picked[:n-1]
+		c.Unlock()
+		// the object could be claimed or removed by anyone since the fetch
+		set := c.objectsKey
+		if _, ok := e[fieldReadOnly]; ok {
+			set = c.readOnlyKey
+		}
+		err := c.client.ZScore(set, e[fieldBucket]+"/"+e[fieldKey]).Err()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return o.setCatalogEntry(e)
+	}
+
+	entries, err := c.fetch(c.batch, false)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.picked = append(c.picked, entries[1:]...)
+	c.pickedAt = time.Now()
+	c.Unlock()
+	return o.setCatalogEntry(entries[0])
+}
+
+// PickWritable fetches a single object, as batches of RandomPick mix read-only objects in
+func (c *redisCatalog) PickWritable(o *ObjectSpec) error {
+	entries, err := c.fetch(1, true)
+	if err != nil {
+		return err
+	}
+	return o.setCatalogEntry(entries[0])
+}
+
+func (c *redisCatalog) Remove(o *ObjectSpec) error {
+	id := objectID(o)
+	return removeScript.Run(c.client, c.removeKeys(id), id).Err()
+}
+
+// removeKeys returns KEYS of removeScript for an object id
+func (c *redisCatalog) removeKeys(id string) []string {
+	return []string{c.objectsKey, c.pendingKey, c.entryPrefix + id, c.statsKey, c.readOnlyKey, c.claimedKey}
+}
+
+func (c *redisCatalog) Count() (int64, error) {
+	pipe := c.client.Pipeline()
+	objects, pending, readOnly := pipe.ZCard(c.objectsKey), pipe.ZCard(c.pendingKey), pipe.ZCard(c.readOnlyKey)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return objects.Val() + pending.Val() + readOnly.Val(), nil
+}
+
+func (c *redisCatalog) Runs() ([]RunInfo, error) {
+	ids, err := c.client.SMembers(c.runsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]RunInfo, 0, len(ids))
+	for _, id := range ids {
+		stats, err := c.client.HGetAll(newRedisRunKeys(c.ns, id).statsKey).Result()
+		if err != nil {
+			return nil, err
+		}
+		run := RunInfo{ID: id}
+		run.Objects, _ = strconv.ParseInt(stats[statsObjects], 10, 64)
+		run.Bytes, _ = strconv.ParseInt(stats[statsBytes], 10, 64)
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func (c *redisCatalog) DropRun(id string) error {
+	keys := newRedisRunKeys(c.ns, id)
+	const page = 1000
+	for _, set := range []string{keys.objectsKey, keys.pendingKey, keys.readOnlyKey} {
+		for {
+			// deleting from the head, so always read the first page
+			ids, err := c.client.ZRange(set, 0, page-1).Result()
+			if err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				break
+			}
+			pipe := c.client.Pipeline()
+			members := make([]interface{}, len(ids))
+			for i, id := range ids {
+				pipe.Del(keys.entryPrefix + id)
+				members[i] = id
+			}
+			pipe.ZRem(set, members...)
+			if _, err := pipe.Exec(); err != nil {
+				return err
+			}
+		}
+	}
+	pipe := c.client.Pipeline()
+	pipe.Del(keys.objectsKey, keys.readOnlyKey, keys.pendingKey, keys.claimedKey, keys.seqKey, keys.statsKey, keys.reservedKey, keys.bucketsKey)
+	pipe.SRem(c.runsKey, id)
+	_, err := pipe.Exec()
+	return err
+}
+
+func (c *redisCatalog) AddBucket(name string) error {
+	return c.client.SAdd(c.bucketsKey, name).Err()
+}
+
+func (c *redisCatalog) Buckets() ([]string, error) {
+	return c.client.SMembers(c.bucketsKey).Result()
+}
+
+func (c *redisCatalog) RemoveBucket(name string) error {
+	return c.client.SRem(c.bucketsKey, name).Err()
+}
+
+func (c *redisCatalog) Reserve(size, targetObjects, targetBytes int64) (string, error) {
+	reservation := fmt.Sprintf("%s:%d:%d", workerID, atomic.AddInt64(&c.reservations, 1), size)
+	keys := []string{c.statsKey, c.reservedKey}
+	now := time.Now().UnixNano() / 1e6
+	ok, err := reserveScript.Run(c.client, keys, reservation, targetObjects, targetBytes, now, c.lease.Nanoseconds()/1e6).Int64()
+	if err != nil || ok != 1 {
+		return "", err
+	}
+	return reservation, nil
+}
+
+func (c *redisCatalog) Unreserve(reservation string) error {
+	return c.client.ZRem(c.reservedKey, reservation).Err()
+}
+
+func (c *redisCatalog) Claim(o *ObjectSpec) error {
+	c.reaper.Do(func() { go c.reap() })
+	// an entry could be gone, e.g. evicted. drop it and try another one, until the sorted set
+	// is really empty.
+	for {
+		keys := []string{c.objectsKey, c.pendingKey, c.claimedKey}
+		vals, err := claimScript.Run(c.client, keys, randstr.Default.Float64(), time.Now().Unix(), c.entryPrefix).Result()
+		if err != nil {
+			return err
+		}
+		result, _ := vals.([]interface{})
+		if len(result) == 0 {
+			return ErrEmptyCatalog
+		}
+		id, _ := result[0].(string)
+		e := make(map[string]string)
+		for i := 1; i+1 < len(result); i += 2 {
+			field, _ := result[i].(string)
+			value, _ := result[i+1].(string)
+			e[field] = value
+		}
+		if err := o.setCatalogEntry(e); err == nil {
+			return nil
+		}
+		removeScript.Run(c.client, c.removeKeys(id), id)
+	}
+}
+
+func (c *redisCatalog) Confirm(o *ObjectSpec) error {
+	return c.Remove(o)
+}
+
+func (c *redisCatalog) Release(o *ObjectSpec) error {
+	return releaseScript.Run(c.client, c.releaseKeys(), objectID(o)).Err()
+}
+
+// releaseKeys returns KEYS of releaseScript
+func (c *redisCatalog) releaseKeys() []string {
+	return []string{c.seqKey, c.objectsKey, c.pendingKey, c.claimedKey}
+}
+
+func (c *redisCatalog) ReleaseAll() error {
+	const page = 1000
+	for {
+		// released ones leave pending, so always read the first page
+		ids, err := c.client.ZRange(c.pendingKey, 0, page-1).Result()
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		for _, id := range ids {
+			if err := releaseScript.Run(c.client, c.releaseKeys(), id).Err(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reap puts back objects claimed longer than the lease
+func (c *redisCatalog) reap() {
+	for range time.Tick(c.lease / 2) {
+		expired := strconv.FormatInt(time.Now().Add(-c.lease).Unix(), 10)
+		ids, err := c.client.ZRangeByScore(c.pendingKey, redis.ZRangeBy{Min: "-inf", Max: expired}).Result()
+		if err != nil {
+			fmt.Printf("failed to find expired claims with %s\n", err.Error())
+			continue
+		}
+		for _, id := range ids {
+			releaseScript.Run(c.client, c.releaseKeys(), id)
+		}
+	}
+}
+
+func (c *redisCatalog) ForEach(fn func(o *ObjectSpec) error) error {
+	for _, set := range []string{c.readOnlyKey, c.objectsKey, c.pendingKey} {
+		if err := c.forEachIn(set, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachIn calls fn with every object of a sorted set, page by page
+func (c *redisCatalog) forEachIn(set string, fn func(o *ObjectSpec) error) error {
+	const page = 1000
+	for start := int64(0); ; start += page {
+		ids, err := c.client.ZRange(set, start, start+page-1).Result()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			e, err := c.client.HGetAll(c.entryPrefix + id).Result()
+			if err != nil {
+				return err
+			}
+			var o ObjectSpec
+			if o.setCatalogEntry(e) != nil {
+				continue
+			}
+			if err := fn(&o); err != nil {
+				return err
+			}
+		}
+		if len(ids) < page {
+			return nil
+		}
+	}
+}
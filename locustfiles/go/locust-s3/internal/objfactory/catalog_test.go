@@ -0,0 +1,245 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+)
+
+// catalogs which run in the test process. redis catalog needs a server.
+var testCatalogs = []struct {
+	name string
+	open func(t *testing.T) Catalog
+}{
+	{"memory", func(t *testing.T) Catalog { return newMemoryCatalog() }},
+	{"disk", func(t *testing.T) Catalog { return openDiskCatalog(t, filepath.Join(t.TempDir(), "catalog.db")) }},
+}
+
+func openDiskCatalog(t *testing.T, path string) *diskCatalog {
+	config.LoadConf.Cache.Path = path
+	c := newDiskCatalog()
+	t.Cleanup(func() { c.db.Close() })
+	return c
+}
+
+func testObject(i int) *ObjectSpec {
+	return &ObjectSpec{ObjectBucket: "bucket1", ObjectKey: fmt.Sprintf("key%d", i), ObjectSize: int64(i)}
+}
+
+// forEachCatalog runs test on a catalog of every type holding objects
+func forEachCatalog(t *testing.T, objects []*ObjectSpec, test func(t *testing.T, c Catalog)) {
+	for _, tc := range testCatalogs {
+		t.Run(tc.name, func(t *testing.T) {
+			c := tc.open(t)
+			for _, o := range objects {
+				if err := c.Add(o); err != nil {
+					t.Fatal(err)
+				}
+			}
+			test(t, c)
+		})
+	}
+}
+
+func expectCount(t *testing.T, c Catalog, want int64) {
+	t.Helper()
+	if n, err := c.Count(); n != want || err != nil {
+		t.Fatalf("count is %d with %v, expect %d", n, err, want)
+	}
+}
+
+func TestCatalogAdd(t *testing.T) {
+	forEachCatalog(t, []*ObjectSpec{testObject(0), testObject(1), testObject(2)}, func(t *testing.T, c Catalog) {
+		// an object written again replaces the recorded one
+		again := testObject(1)
+		again.ObjectSize = 100
+		if err := c.Add(again); err != nil {
+			t.Fatal(err)
+		}
+		expectCount(t, c, 3)
+		if err := c.Remove(testObject(0)); err != nil {
+			t.Fatal(err)
+		}
+		expectCount(t, c, 2)
+		for i := 0; i < 50; i++ {
+			var o ObjectSpec
+			if err := c.RandomPick(&o); err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case o.ObjectKey == "key1" && o.ObjectSize == 100:
+			case o.ObjectKey == "key2" && o.ObjectSize == 2:
+			default:
+				t.Fatalf("picked %s of size %d", o.ObjectKey, o.ObjectSize)
+			}
+		}
+	})
+	forEachCatalog(t, nil, func(t *testing.T, c Catalog) {
+		var o ObjectSpec
+		if err := c.RandomPick(&o); err != ErrEmptyCatalog {
+			t.Fatalf("pick of empty catalog returns %v", err)
+		}
+	})
+}
+
+// keys returns keys of all objects of the catalog
+func keys(t *testing.T, c Catalog) map[string]bool {
+	t.Helper()
+	seen := make(map[string]bool)
+	err := c.ForEach(func(o *ObjectSpec) error {
+		seen[o.ObjectKey] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seen
+}
+
+func TestCatalogForEach(t *testing.T) {
+	forEachCatalog(t, []*ObjectSpec{testObject(0), testObject(1), testObject(2)}, func(t *testing.T, c Catalog) {
+		if err := c.Remove(testObject(1)); err != nil {
+			t.Fatal(err)
+		}
+		// claimed objects are still recorded
+		var claimed ObjectSpec
+		if err := c.Claim(&claimed); err != nil {
+			t.Fatal(err)
+		}
+		if seen := keys(t, c); len(seen) != 2 || !seen["key0"] || !seen["key2"] {
+			t.Fatalf("objects are %v", seen)
+		}
+	})
+}
+
+func TestDiskCatalogReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.db")
+	c := openDiskCatalog(t, path)
+	for i := 0; i < 3; i++ {
+		if err := c.Add(testObject(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var claimed ObjectSpec
+	if err := c.Claim(&claimed); err != nil {
+		t.Fatal(err)
+	}
+	c.db.Close()
+
+	// claims of a runner which exited are released
+	c = openDiskCatalog(t, path)
+	expectCount(t, c, 3)
+	for i := 0; i < 3; i++ {
+		var o ObjectSpec
+		if err := c.Claim(&o); err != nil {
+			t.Fatalf("claim %d after reopen failed with %v", i, err)
+		}
+	}
+}
+
+func TestCatalogClaim(t *testing.T) {
+	tests := []struct {
+		name    string
+		confirm bool // the object is deleted, otherwise delete failed
+		count   int64
+		picked  error
+	}{
+		{"confirm", true, 0, ErrEmptyCatalog},
+		{"release", false, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachCatalog(t, []*ObjectSpec{testObject(0)}, func(t *testing.T, c Catalog) {
+				var claimed, o ObjectSpec
+				if err := c.Claim(&claimed); err != nil || claimed.ObjectKey != "key0" {
+					t.Fatalf("claimed %s with %v", claimed.ObjectKey, err)
+				}
+				// a claimed object is neither read nor deleted by others
+				if err := c.RandomPick(&o); err != ErrEmptyCatalog {
+					t.Fatalf("pick of claimed object returns %v", err)
+				}
+				if err := c.Claim(&o); err != ErrEmptyCatalog {
+					t.Fatalf("claim of claimed object returns %v", err)
+				}
+				var err error
+				if tt.confirm {
+					err = c.Confirm(&claimed)
+				} else {
+					err = c.Release(&claimed)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectCount(t, c, tt.count)
+				if err := c.RandomPick(&o); err != tt.picked {
+					t.Fatalf("pick returns %v, expect %v", err, tt.picked)
+				}
+			})
+		})
+	}
+}
+
+func TestCatalogReleaseAll(t *testing.T) {
+	forEachCatalog(t, []*ObjectSpec{testObject(0), testObject(1)}, func(t *testing.T, c Catalog) {
+		for i := 0; i < 2; i++ {
+			var o ObjectSpec
+			if err := c.Claim(&o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.ReleaseAll(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			var o ObjectSpec
+			if err := c.Claim(&o); err != nil {
+				t.Fatalf("claim %d after release failed with %v", i, err)
+			}
+		}
+	})
+}
+
+func TestCatalogReadOnly(t *testing.T) {
+	readOnly := testObject(0)
+	readOnly.ReadOnly = true
+	forEachCatalog(t, []*ObjectSpec{readOnly, testObject(1)}, func(t *testing.T, c Catalog) {
+		for i := 0; i < 20; i++ {
+			var o ObjectSpec
+			if err := c.PickWritable(&o); err != nil || o.ObjectKey != "key1" {
+				t.Fatalf("picked %s to modify with %v", o.ObjectKey, err)
+			}
+		}
+		var claimed, o ObjectSpec
+		if err := c.Claim(&claimed); err != nil || claimed.ObjectKey != "key1" {
+			t.Fatalf("claimed %s with %v", claimed.ObjectKey, err)
+		}
+		// read-only objects are only read
+		if err := c.Claim(&o); err != ErrEmptyCatalog {
+			t.Fatalf("claim of read-only object returns %v", err)
+		}
+		if err := c.PickWritable(&o); err != ErrEmptyCatalog {
+			t.Fatalf("pick of read-only object to modify returns %v", err)
+		}
+		if err := c.RandomPick(&o); err != nil || o.ObjectKey != "key0" || !o.ReadOnly {
+			t.Fatalf("picked %s with %v", o.ObjectKey, err)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory/payload"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/randstr"
+)
+
+// stream of the seed which duplicate blocks of dedup payload come from
+const dedupPoolStream = -1
+
+// marks objects whose content is unknown, e.g. imported ones
+const unknownPayload = "-"
+
+// newObjectData returns content of a new object. files of the corpus are picked by r.
+func newObjectData(o *ObjectSpec, r *rand.Rand) (io.ReadSeeker, error) {
+	switch config.LoadConf.Data.Payload.Mode {
+	case config.PayloadShared:
+		return FakeObjReadSeeker(o.ObjectSize), nil
+	case config.PayloadCorpus:
+		return corpusObjectData(o, r)
+	default:
+		return payload.NewReader(o.Payload(), o.ObjectSize), nil
+	}
+}
+
+// Payload returns the generator of content of the object, or nil if it is unknown. content is
+// a pure function of bucket, key, size and generation of the object which carries the content,
+// and the seed, so it could be generated again on read instead of keeping checksums.
+func (o *ObjectSpec) Payload() payload.Generator {
+	origin := o.PayloadOf
+	switch origin {
+	case unknownPayload:
+		return nil
+	case "":
+		origin = objectID(o)
+	}
+	switch config.LoadConf.Data.Payload.Mode {
+	case config.PayloadZeros:
+		return payload.Zeros{}
+	case config.PayloadUnique:
+		return uniquePayload(payloadSeed(origin, o.ObjectSize, o.Generation))
+	default:
+		return sharedPayload
+	}
+}
+
+// CopyPayload makes o carry the same content as src
+func (o *ObjectSpec) CopyPayload(src *ObjectSpec) {
+	o.PayloadOf = src.PayloadOf
+	o.Generation = src.Generation
+	if o.PayloadOf == "" {
+		o.PayloadOf = objectID(src)
+	}
+}
+
+// MarkUnknownPayload marks content of o is not generated by locust, so it could not be verified
+func (o *ObjectSpec) MarkUnknownPayload() {
+	o.PayloadOf = unknownPayload
+}
+
+// payloadSeed returns the seed of content of object id. objects catalogued without a
+// generation keep the seed they were written with.
+func payloadSeed(id string, size, generation int64) uint64 {
+	name := fmt.Sprintf("%s/%d", id, size)
+	if generation != 0 {
+		name = fmt.Sprintf("%s/%d", name, generation)
+	}
+	return uint64(randstr.Mix(randstr.Seed, int64(hashString(name))))
+}
+
+// uniquePayload returns an incompressible payload of seed, made compressible and
+// deduplicable by the configured ratios
+func uniquePayload(seed uint64) payload.Generator {
+	p := config.LoadConf.Data.Payload
+	var gen payload.Generator = payload.Random{Seed: seed}
+	var pool payload.Generator = payload.Random{Seed: uint64(randstr.Mix(randstr.Seed, dedupPoolStream))}
+	if p.CompressionRatio > 1 {
+		gen = payload.Compressible{Ratio: p.CompressionRatio, Source: gen}
+		pool = payload.Compressible{Ratio: p.CompressionRatio, Source: pool}
+	}
+	if p.DedupRatio > 1 {
+		gen = payload.Dedup{
+			Ratio:      p.DedupRatio,
+			BlockSize:  p.DedupBlockSize,
+			PoolBlocks: p.DedupPool,
+			Seed:       seed,
+			Unique:     gen,
+			Pool:       pool,
+		}
+	}
+	return gen
+}
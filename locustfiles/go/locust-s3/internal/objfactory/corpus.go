@@ -0,0 +1,211 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+)
+
+// corpusFile is a file of the corpus that objects are uploaded from
+type corpusFile struct {
+	name string // path in the directory or tarball, with / separators
+	size int64
+	open func() (io.ReadSeeker, error)
+}
+
+// corpus holds real files to upload instead of generated content. files of a directory are
+// opened on demand. files of a plain tarball are read in place, at their offsets of the
+// tarball. a compressed tarball could not be read in place, so it is loaded into memory.
+type corpus struct {
+	files []corpusFile
+	next  int64 // for sequential order
+}
+
+var objectCorpus *corpus
+
+func init() {
+	if config.LoadConf.Data.Payload.Mode != config.PayloadCorpus {
+		return
+	}
+	path := config.LoadConf.Data.Payload.Corpus.Path
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Fatalf("failed to open corpus %s with %s", path, err.Error())
+	}
+	switch {
+	case info.IsDir():
+		objectCorpus = loadCorpusDir(path)
+	case strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz"):
+		objectCorpus = loadCorpusTarGz(path)
+	default:
+		objectCorpus = loadCorpusTar(path)
+	}
+	if len(objectCorpus.files) == 0 {
+		log.Fatalf("no file in corpus %s", path)
+	}
+}
+
+func loadCorpusDir(dir string) *corpus {
+	c := &corpus{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		c.files = append(c.files, corpusFile{
+			name: filepath.ToSlash(name),
+			size: info.Size(),
+			open: func() (io.ReadSeeker, error) { return os.Open(path) },
+		})
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("failed to walk corpus %s with %s", dir, err.Error())
+	}
+	return c
+}
+
+// sectionFile reads a section of a tarball, and closes the tarball when done
+type sectionFile struct {
+	*io.SectionReader
+	io.Closer
+}
+
+func loadCorpusTar(path string) *corpus {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("failed to open corpus %s with %s", path, err.Error())
+	}
+	defer f.Close()
+	c := &corpus{}
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("invalid corpus tarball %s with %s", path, err.Error())
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		// tar reader reads headers block by block, so the file is right at the position
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			log.Fatalf("failed to locate %s in corpus %s with %s", h.Name, path, err.Error())
+		}
+		size := h.Size
+		c.files = append(c.files, corpusFile{
+			name: strings.TrimPrefix(h.Name, "./"),
+			size: size,
+			open: func() (io.ReadSeeker, error) {
+				f, err := os.Open(path)
+				if err != nil {
+					return nil, err
+				}
+				return sectionFile{io.NewSectionReader(f, offset, size), f}, nil
+			},
+		})
+	}
+	return c
+}
+
+func loadCorpusTarGz(path string) *corpus {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("failed to open corpus %s with %s", path, err.Error())
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		log.Fatalf("invalid corpus tarball %s with %s", path, err.Error())
+	}
+	c := &corpus{}
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("invalid corpus tarball %s with %s", path, err.Error())
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			log.Fatalf("failed to read %s of corpus %s with %s", h.Name, path, err.Error())
+		}
+		c.files = append(c.files, corpusFile{
+			name: strings.TrimPrefix(h.Name, "./"),
+			size: int64(len(content)),
+			open: func() (io.ReadSeeker, error) { return bytes.NewReader(content), nil },
+		})
+	}
+	return c
+}
+
+// CorpusDataset returns the most objects and bytes uploads of the corpus make if keys come
+// from paths of files, as a file uploaded again overwrites its object. ok is false if keys
+// do not come from paths.
+func CorpusDataset() (objects, bytes int64, ok bool) {
+	if objectCorpus == nil || !config.LoadConf.Data.Payload.Corpus.KeyFromPath {
+		return 0, 0, false
+	}
+	for _, f := range objectCorpus.files {
+		bytes += f.size
+	}
+	buckets := int64(len(config.LoadConf.Data.Buckets))
+	return int64(len(objectCorpus.files)) * buckets, bytes * buckets, true
+}
+
+// pick returns the next file to upload, at random by r or in order
+func (c *corpus) pick(r *rand.Rand) *corpusFile {
+	if config.LoadConf.Data.Payload.Corpus.Order == config.CorpusSequential {
+		return &c.files[(atomic.AddInt64(&c.next, 1)-1)%int64(len(c.files))]
+	}
+	return &c.files[r.Intn(len(c.files))]
+}
+
+// corpusObjectData picks a file of the corpus as content of o. size of o becomes the size
+// of the file, and key of o is derived from the path of the file if key_from_path is enabled.
+func corpusObjectData(o *ObjectSpec, r *rand.Rand) (io.ReadSeeker, error) {
+	f := objectCorpus.pick(r)
+	o.ObjectSize = f.size
+	if config.LoadConf.Data.Payload.Corpus.KeyFromPath {
+		o.ObjectKey = config.LoadConf.Data.ObjectPrefix + f.name
+	}
+	o.MarkUnknownPayload()
+	return f.open()
+}
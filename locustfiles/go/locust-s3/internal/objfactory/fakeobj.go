@@ -17,68 +17,25 @@ Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
 package objfactory
 
 import (
-	"errors"
 	"io"
-	"math/rand"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory/payload"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/randstr"
 )
 
 const bufferSizeBits = 23
 const bufferSize = 1 << bufferSizeBits // a shared buffer to reduce run time overhead
 
-var bufferBytes []byte
+// sharedPayload is content of the shared buffer, generated from the seed so it could be
+// verified on read
+var sharedPayload *payload.Shared
 
 func init() {
-	const bufferSize = 1 << bufferSizeBits
-	bufferBytes = make([]byte, bufferSize, bufferSize)
-	if _, err := rand.Read(bufferBytes); err != nil {
-		panic("could not initiate buffer")
-	}
-}
-
-func min(a, b int64) int64 {
-	if a < b {
-		return a
-	}
-	return b
+	sharedPayload = payload.NewShared(uint64(randstr.Seed), bufferSize)
 }
 
-// FakeObjReadSeeker implement a io.ReadSeeker interface to expose an arbitary size buffer
+// FakeObjReadSeeker exposes an arbitrary size object which repeats the shared buffer. the
+// returned reader also implements io.ReaderAt and io.WriterTo.
 func FakeObjReadSeeker(size int64) io.ReadSeeker {
-	return &fakeObjReader{size, 0}
-}
-
-type fakeObjReader struct {
-	size   int64 // the size of the object this reader represent
-	curPos int64 // current reading index
-}
-
-func (r *fakeObjReader) Read(b []byte) (n int, err error) {
-	if r.curPos >= r.size {
-		return 0, io.EOF
-	}
-	// TODO, need a better bitmask based way
-	posInBuffer := r.curPos - (r.curPos>>bufferSizeBits)<<bufferSizeBits
-	n = copy(b, bufferBytes[posInBuffer:min(posInBuffer+(r.size-r.curPos), bufferSize)])
-	r.curPos += int64(n)
-	return
-}
-
-func (r *fakeObjReader) Seek(offset int64, whence int) (int64, error) {
-	// similar to https://golang.org/src/bytes/reader.go?s=2903:2965#L107
-	var abs int64
-	switch whence {
-	case io.SeekStart:
-		abs = offset
-	case io.SeekCurrent:
-		abs = r.curPos + offset
-	case io.SeekEnd:
-		abs = r.size + offset
-	default:
-		return 0, errors.New("bytes.Reader.Seek: invalid whence")
-	}
-	if abs < 0 {
-		return 0, errors.New("bytes.Reader.Seek: negative position")
-	}
-	r.curPos = abs
-	return abs, nil
+	return payload.NewReader(sharedPayload, size)
 }
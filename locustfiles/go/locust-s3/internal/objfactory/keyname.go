@@ -0,0 +1,198 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/randstr"
+)
+
+// S3 keys are at most 1024 bytes of UTF-8
+const maxKeyLen = 1024
+
+// named charsets of {random}. any other charset value is used as the characters themselves.
+var keyCharsets = map[string]string{
+	"letters":      "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"alphanumeric": "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789",
+	"hex":          "0123456789abcdef",
+	"digits":       "0123456789",
+	// multi-byte characters of a few scripts
+	"utf8": "abcdefghijklmnopqrstuvwxyzäöüßéñçøåæΩλπжяשׁ中文字日本語한국어",
+	// characters which have to be percent encoded in a URL
+	"urlunsafe": "abcdefghijklmnopqrstuvwxyz %+?#&=;:@,!$'()*[]",
+}
+
+var keyPlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// keyTemplate renders object keys from a template like {prefix}/{date}/{worker}/{seq}.
+// the template is split into literal text and placeholders once, at start.
+type keyTemplate struct {
+	parts []string // literal text at even positions, placeholder names at odd positions
+}
+
+var objectKeys *keyTemplate
+
+// {worker} is this Go runner, which is unique across runners if LT_WORKER_ID is not given
+var workerID = runnerID()
+
+func runnerID() string {
+	if id := os.Getenv("LT_WORKER_ID"); id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func init() {
+	objectKeys = newKeyTemplate(config.LoadConf.Data.Key.Template)
+	if n := objectKeys.maxLen(); n > maxKeyLen {
+		log.Fatalf("object keys of key template %s could be %d bytes, longer than %d bytes", config.LoadConf.Data.Key.Template, n, maxKeyLen)
+	}
+}
+
+func newKeyTemplate(template string) *keyTemplate {
+	t := &keyTemplate{}
+	last := 0
+	for _, m := range keyPlaceholder.FindAllStringSubmatchIndex(template, -1) {
+		name := template[m[2]:m[3]]
+		switch name {
+		case "prefix", "random", "seq", "worker", "run", "date", "time", "dirs", "hash":
+		default:
+			log.Fatalf("unknown placeholder {%s} in key template %s", name, template)
+		}
+		t.parts = append(t.parts, template[last:m[0]], name)
+		last = m[1]
+	}
+	t.parts = append(t.parts, template[last:])
+	return t
+}
+
+// maxLen returns the longest key the template could render, in bytes
+func (t *keyTemplate) maxLen() int {
+	key := config.LoadConf.Data.Key
+	n := 0
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			n += len(part)
+			continue
+		}
+		switch part {
+		case "prefix":
+			n += len(config.LoadConf.Data.ObjectPrefix)
+		case "random":
+			charset, ok := keyCharsets[key.Charset]
+			if !ok {
+				charset = key.Charset
+			}
+			widest := 0
+			for _, c := range charset {
+				if w := utf8.RuneLen(c); w > widest {
+					widest = w
+				}
+			}
+			n += key.Length * widest
+		case "seq", "time":
+			// digits of the largest int64
+			n += len(strconv.FormatInt(math.MaxInt64, 10))
+		case "worker":
+			n += len(workerID)
+		case "run":
+			n += len(config.LoadConf.Cache.RunID)
+		case "date":
+			n += len("2006/01/02")
+		case "dirs":
+			n += key.Depth*(len(fmt.Sprintf("%x", key.Fanout-1))+1) - 1
+		case "hash":
+			n += key.HashLength
+		}
+	}
+	return n
+}
+
+// randomKeyPart returns {random} of the configured length and charset
+func randomKeyPart(r *rand.Rand) string {
+	key := config.LoadConf.Data.Key
+	if key.Charset == "letters" {
+		return randstr.Letters(r, key.Length)
+	}
+	charset, ok := keyCharsets[key.Charset]
+	if !ok {
+		charset = key.Charset
+	}
+	return randstr.RandStringFrom(r, key.Length, []rune(charset))
+}
+
+// dirsKeyPart returns depth levels of directories, each one of fanout names
+func dirsKeyPart(r *rand.Rand) string {
+	key := config.LoadConf.Data.Key
+	width := len(fmt.Sprintf("%x", key.Fanout-1))
+	dirs := make([]string, key.Depth)
+	for i := range dirs {
+		dirs[i] = fmt.Sprintf("%0*x", width, r.Intn(key.Fanout))
+	}
+	return strings.Join(dirs, "/")
+}
+
+// newKey renders the key of the seq-th object generated by r. {hash} is the hex hash of the rest of the key, so keys
+// sharing everything else still spread over hash prefixes.
+func (t *keyTemplate) newKey(r *rand.Rand, seq int64) string {
+	var b strings.Builder
+	hashAt := -1
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+		switch part {
+		case "prefix":
+			b.WriteString(config.LoadConf.Data.ObjectPrefix)
+		case "random":
+			b.WriteString(randomKeyPart(r))
+		case "seq":
+			fmt.Fprintf(&b, "%012d", seq)
+		case "worker":
+			b.WriteString(workerID)
+		case "run":
+			b.WriteString(config.LoadConf.Cache.RunID)
+		case "date":
+			b.WriteString(time.Now().UTC().Format("2006/01/02"))
+		case "time":
+			fmt.Fprintf(&b, "%d", time.Now().UnixNano())
+		case "dirs":
+			b.WriteString(dirsKeyPart(r))
+		case "hash":
+			hashAt = b.Len()
+		}
+	}
+	key := b.String()
+	if hashAt >= 0 {
+		hash := fmt.Sprintf("%016x", hashString(key))[:config.LoadConf.Data.Key.HashLength]
+		key = key[:hashAt] + hash + key[hashAt:]
+	}
+	return key
+}
@@ -17,11 +17,17 @@ Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
 package objfactory
 
 import (
+	crand "crypto/rand"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"math/rand"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
 	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/randstr"
@@ -32,6 +38,10 @@ const (
 	Write = iota
 	Read
 	Delete
+	Copy
+	Overwrite
+	// Modify changes sub-resources of an object, e.g. tags, so read-only objects are not picked
+	Modify
 )
 
 // ObjectSpec prepare an object for certain operations
@@ -40,10 +50,31 @@ type ObjectSpec struct {
 	ObjectKey    string
 	ObjectSize   int64
 	ObjectData   io.ReadSeeker
-	operation    int
+	// user metadata (x-amz-meta-*) and tags attached on upload
+	ObjectMetadata map[string]string
+	ObjectTags     map[string]string
+	// raw customer provided key if object is encrypted with SSE-C
+	SSECustomerKey string
+	// ETag and Last-Modified returned by upload. only kept if cache_etag is enabled
+	ETag         string
+	LastModified time.Time
+	// version created by upload, and until when the version is protected by object lock
+	VersionID   string
+	RetainUntil time.Time
+	LegalHold   bool
+	// bucket/key of the object whose content this object carries, e.g. source of a copy.
+	// it is empty for an object with content of its own, and unknownPayload if not written by locust.
+	PayloadOf string
+	// write which generated the content, so an overwrite of the same size has new content
+	Generation int64
+	// objects not written by locust, e.g. imported, are only read. they are never claimed
+	// to be deleted or overwritten.
+	ReadOnly  bool
+	operation int
 }
 
-const objectKeyLen = 16
+// SSE-C requires a 256 bits AES key
+const sseCustomerKeyLen = 32
 
 var bucketCount int
 var sizeWeight []string
@@ -51,7 +82,14 @@ var sizeWeightLen int
 
 func init() {
 	bucketCount = len(config.LoadConf.Data.Buckets)
-	for k, v := range config.LoadConf.Data.Weights {
+	// ranges are sorted, so the same seed picks the same sizes no matter the map order
+	ranges := make([]string, 0, len(config.LoadConf.Data.Weights))
+	for k := range config.LoadConf.Data.Weights {
+		ranges = append(ranges, k)
+	}
+	sort.Strings(ranges)
+	for _, k := range ranges {
+		v := config.LoadConf.Data.Weights[k]
 		var b []string
 		b = make([]string, v["WEIGHT"])
 		for i := 0; i < int(v["WEIGHT"]); i++ {
@@ -62,12 +100,37 @@ func init() {
 	sizeWeightLen = len(sizeWeight)
 }
 
-func objSizeViaPolicy() int64 {
-	rangePicked := rand.Intn(sizeWeightLen)
+// seed of this runner. package variables are initialized before any init function, so
+// randstr is seeded before it is used.
+var runnerSeed = randstr.Init(config.LoadConf.Locust.Seed)
+
+// writes of this runner, each one with a random generator of its own. the stream of the
+// runner is derived from {worker}, so runners sharing a seed never generate the same objects.
+var (
+	workerSeed = randstr.Mix(runnerSeed, int64(hashString(workerID)))
+	writes     int64
+)
+
+// objectRand returns the random generator and sequence number of the next object. it is derived from the seed,
+// worker id and number of objects generated before, so the same seed generates the same
+// sequence of objects per runner no matter how virtual users interleave.
+func objectRand() (*rand.Rand, int64) {
+	seq := atomic.AddInt64(&writes, 1)
+	return randstr.New(randstr.Mix(workerSeed, seq)), seq
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func objSizeViaPolicy(rnd *rand.Rand) int64 {
+	rangePicked := rnd.Intn(sizeWeightLen)
 	r := config.LoadConf.Data.Weights[sizeWeight[rangePicked]]
 	switch strings.ToLower(config.LoadConf.Data.SizingOption) {
 	case "random":
-		return int64(r["LOW"]) + int64(rand.Intn(int(r["HIGH"]-r["LOW"])))
+		return int64(r["LOW"]) + int64(rnd.Intn(int(r["HIGH"]-r["LOW"])))
 	case "low_bound":
 		return int64(r["LOW"])
 	default:
@@ -75,38 +138,179 @@ func objSizeViaPolicy() int64 {
 	}
 }
 
+// generateAttributes returns count random name/value pairs with value of size bytes.
+// it is used to build both user metadata and object tags.
+func generateAttributes(r *rand.Rand, prefix string, count, size int) map[string]string {
+	if count <= 0 {
+		return nil
+	}
+	attrs := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		attrs[config.AttributeName(prefix, i)] = randstr.Letters(r, size)
+	}
+	return attrs
+}
+
+// GenerateTags returns count random tags with value of size bytes
+func GenerateTags(count, size int) map[string]string {
+	return generateAttributes(randstr.Default, config.TagPrefix, count, size)
+}
+
+// newSSECustomerKey returns a new 256 bits key if SSE-C is enabled, otherwise an empty string
+func newSSECustomerKey() string {
+	if config.LoadConf.Data.Encryption.Mode != config.EncryptionSSEC {
+		return ""
+	}
+	key := make([]byte, sseCustomerKeyLen)
+	if _, err := crand.Read(key); err != nil {
+		log.Fatalf("failed to generate SSE-C key with %s", err.Error())
+	}
+	return string(key)
+}
+
+// retainUntil returns until when a new object will be protected by retention
+func retainUntil() time.Time {
+	lock := &config.LoadConf.Data.ObjectLock
+	switch {
+	case !lock.Enabled:
+		return time.Time{}
+	case lock.Retention.Mode != "":
+		return time.Now().Add(lock.Retention.Duration)
+	case lock.DefaultRetention.Mode != "":
+		return time.Now().AddDate(0, 0, int(lock.DefaultRetention.Days))
+	default:
+		return time.Time{}
+	}
+}
+
+// Locked tells if the object version could not be deleted because of object lock
+func (o *ObjectSpec) Locked() bool {
+	return o.LegalHold || time.Now().Before(o.RetainUntil)
+}
+
 // GetObject will initialize an object for certain operation
 func (o *ObjectSpec) GetObject(operation int) error {
 	switch operation {
 	case Write:
-		o.ObjectBucket = config.LoadConf.Data.Buckets[rand.Intn(bucketCount)]
-		o.ObjectKey = fmt.Sprintf("%s%s", config.LoadConf.Data.ObjectPrefix,
-			randstr.RandStringBytesMaskImprSrc(objectKeyLen))
-		o.ObjectSize = objSizeViaPolicy()
-		o.ObjectData = FakeObjReadSeeker(o.ObjectSize)
+		r, seq := objectRand()
+		o.ObjectBucket = config.LoadConf.Data.Buckets[r.Intn(bucketCount)]
+		o.ObjectKey = objectKeys.newKey(r, seq)
+		if err := o.fillContent(r, seq); err != nil {
+			return err
+		}
+		o.operation = operation
+		return nil
+	case Copy:
+		// only destination of copy is prepared here. data comes from the source object.
+		r, seq := objectRand()
+		o.ObjectBucket = config.LoadConf.Data.Buckets[r.Intn(bucketCount)]
+		o.ObjectKey = objectKeys.newKey(r, seq)
+		o.SSECustomerKey = newSSECustomerKey()
 		o.operation = operation
 		return nil
-	case Read, Delete:
+	case Overwrite:
+		// the object is claimed, so no one else reads or deletes it while its content changes
+		o.operation = operation
+		if catalog == nil {
+			return errors.New("no cache enabled at all")
+		}
+		if err := catalog.Claim(o); err != nil {
+			return err
+		}
+		r, seq := objectRand()
+		// bucket and key stay, even if a corpus file would name the key
+		key := o.ObjectKey
+		err := o.fillContent(r, seq)
+		o.ObjectKey = key
+		if err != nil {
+			catalog.Release(o)
+			return err
+		}
+		return nil
+	case Read:
+		o.operation = operation
+		if catalog == nil {
+			return errors.New("no cache enabled at all")
+		}
+		return catalog.RandomPick(o)
+	case Modify:
+		o.operation = operation
+		if catalog == nil {
+			return errors.New("no cache enabled at all")
+		}
+		return catalog.PickWritable(o)
+	case Delete:
+		// the object is claimed, so no one else reads or deletes it while it is being deleted
 		o.operation = operation
-		return cacheRandomPickObject(o)
+		if catalog == nil {
+			return errors.New("no cache enabled at all")
+		}
+		return catalog.Claim(o)
 	default:
 		log.Fatalf("Unsupported operation %d", o.operation)
 		return nil
 	}
 }
 
+// fillContent generates size, content, attributes and protection of write seq of the object
+func (o *ObjectSpec) fillContent(r *rand.Rand, seq int64) error {
+	o.ObjectSize = objectSize(r)
+	o.PayloadOf = ""
+	o.Generation = randstr.Mix(workerSeed, seq)
+	data, err := newObjectData(o, r)
+	if err != nil {
+		return err
+	}
+	o.ObjectData = data
+	o.ObjectMetadata = generateAttributes(r, config.MetadataPrefix,
+		config.LoadConf.Ops.PutObject.Metadata.Count, config.LoadConf.Ops.PutObject.Metadata.Size)
+	o.ObjectTags = generateAttributes(r, config.TagPrefix,
+		config.LoadConf.Ops.PutObject.Tags.Count, config.LoadConf.Ops.PutObject.Tags.Size)
+	o.SSECustomerKey = newSSECustomerKey()
+	o.RetainUntil = retainUntil()
+	o.LegalHold = config.LoadConf.Data.ObjectLock.LegalHold
+	return nil
+}
+
 // ReleaseObject will perform post processing
 func (o *ObjectSpec) ReleaseObject(err error) {
+	// files of the corpus are open until the upload is done
+	if c, ok := o.ObjectData.(io.Closer); ok {
+		c.Close()
+	}
 	switch o.operation {
-	case Write:
-		if err == nil && config.LoadConf.Data.CacheResult {
-			cacheAddObject(o)
+	case Write, Copy:
+		if err == nil && catalog != nil {
+			if err := catalog.Add(o); err != nil {
+				fmt.Printf("failed to add key to cache with %s\n", err.Error())
+			}
 		}
-	case Read:
+	case Read, Modify:
 		// do nothing here.
+	case Overwrite:
+		if catalog == nil {
+			return
+		}
+		// the entry of old content is replaced, or given back if content did not change
+		if err != nil {
+			if err := catalog.Release(o); err != nil {
+				fmt.Printf("failed to release key to cache with %s\n", err.Error())
+			}
+		} else if err := catalog.Confirm(o); err != nil {
+			fmt.Printf("failed to remove key from cache with %s\n", err.Error())
+		} else if err := catalog.Add(o); err != nil {
+			fmt.Printf("failed to add key to cache with %s\n", err.Error())
+		}
 	case Delete:
+		if catalog == nil {
+			return
+		}
 		if err == nil {
-			cacheRemoveObject(o)
+			if err := catalog.Confirm(o); err != nil {
+				fmt.Printf("failed to remove key from cache with %s\n", err.Error())
+			}
+		} else if err := catalog.Release(o); err != nil {
+			fmt.Printf("failed to release key to cache with %s\n", err.Error())
 		}
 	default:
 		log.Fatalf("Object with unsupported operation %s,%s,%d", o.ObjectBucket, o.ObjectKey, o.operation)
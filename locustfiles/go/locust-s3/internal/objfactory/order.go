@@ -0,0 +1,210 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import "sort"
+
+// rankTree is a Fenwick tree of 0 or 1 per position, which finds the position of the n-th 1
+// in O(log n)
+type rankTree struct {
+	tree  []int32 // 1-based, node i sums positions (i-lowbit(i), i]
+	total int64
+}
+
+// push appends a position with value v
+func (t *rankTree) push(v int32) {
+	if len(t.tree) == 0 {
+		t.tree = []int32{0}
+	}
+	i := len(t.tree)
+	sum := v
+	for j := i - 1; j > i-(i&-i); j -= j & -j {
+		sum += t.tree[j]
+	}
+	t.tree = append(t.tree, sum)
+	t.total += int64(v)
+}
+
+// truncate keeps the first n positions
+func (t *rankTree) truncate(n int) {
+	if len(t.tree) <= n+1 {
+		return
+	}
+	t.tree = t.tree[:n+1]
+	t.total = 0
+	for i := n; i > 0; i -= i & -i {
+		t.total += int64(t.tree[i])
+	}
+}
+
+// add adds d to the value of position pos
+func (t *rankTree) add(pos int, d int32) {
+	for i := pos + 1; i < len(t.tree); i += i & -i {
+		t.tree[i] += d
+	}
+	t.total += int64(d)
+}
+
+// find returns the position of the 1 of rank, counted from 0. rank must be less than total.
+func (t *rankTree) find(rank int64) int {
+	pos := 0
+	step := 1
+	for step*2 < len(t.tree) {
+		step *= 2
+	}
+	for ; step > 0; step /= 2 {
+		if pos+step < len(t.tree) && int64(t.tree[pos+step]) <= rank {
+			pos += step
+			rank -= int64(t.tree[pos])
+		}
+	}
+	return pos
+}
+
+// states of an object in insertionOrder
+const (
+	orderRemoved uint8 = iota
+	orderClaimed
+	orderReadOnly
+	orderWritable
+)
+
+// insertionOrder keeps ids of catalog entries sorted by id, which is insertion order. ranks
+// count only objects which could be picked or claimed, so picks follow insertion order no
+// matter how many objects are removed or claimed in between. removed ids are dropped once
+// they are half of the ids.
+type insertionOrder struct {
+	ids    []uint64
+	states []uint8
+	picks  rankTree // 1 for read-only and writable objects
+	claims rankTree // 1 for writable objects
+	live   int      // ids not removed
+}
+
+func pickable(state uint8) int32 {
+	if state >= orderReadOnly {
+		return 1
+	}
+	return 0
+}
+
+func claimable(state uint8) int32 {
+	if state == orderWritable {
+		return 1
+	}
+	return 0
+}
+
+// entryState returns the state of a catalog entry which is not claimed
+func entryState(e map[string]string) uint8 {
+	if _, ok := e[fieldReadOnly]; ok {
+		return orderReadOnly
+	}
+	return orderWritable
+}
+
+func (o *insertionOrder) search(id uint64) int {
+	return sort.Search(len(o.ids), func(i int) bool { return o.ids[i] >= id })
+}
+
+// insert adds a new id. ids are usually inserted in increasing order, an id inserted after
+// larger ones costs a rebuild of the positions after it.
+func (o *insertionOrder) insert(id uint64, state uint8) {
+	pos := o.search(id)
+	if pos < len(o.ids) && o.ids[pos] == id {
+		o.set(id, state)
+		return
+	}
+	o.ids = append(o.ids, 0)
+	o.states = append(o.states, 0)
+	copy(o.ids[pos+1:], o.ids[pos:])
+	copy(o.states[pos+1:], o.states[pos:])
+	o.ids[pos], o.states[pos] = id, state
+	o.picks.truncate(pos)
+	o.claims.truncate(pos)
+	for _, s := range o.states[pos:] {
+		o.picks.push(pickable(s))
+		o.claims.push(claimable(s))
+	}
+	o.live++
+}
+
+// state returns the state of id, which is orderRemoved if id is unknown
+func (o *insertionOrder) state(id uint64) uint8 {
+	if pos := o.search(id); pos < len(o.ids) && o.ids[pos] == id {
+		return o.states[pos]
+	}
+	return orderRemoved
+}
+
+// set changes the state of a known id
+func (o *insertionOrder) set(id uint64, state uint8) {
+	pos := o.search(id)
+	if pos == len(o.ids) || o.ids[pos] != id || o.states[pos] == orderRemoved {
+		return
+	}
+	old := o.states[pos]
+	o.states[pos] = state
+	o.picks.add(pos, pickable(state)-pickable(old))
+	o.claims.add(pos, claimable(state)-claimable(old))
+	if state == orderRemoved {
+		o.live--
+		if len(o.ids) > 2*o.live+1024 {
+			o.compact()
+		}
+	}
+}
+
+// compact drops removed ids
+func (o *insertionOrder) compact() {
+	ids, states := o.ids, o.states
+	*o = insertionOrder{ids: make([]uint64, 0, o.live), states: make([]uint8, 0, o.live)}
+	for i, s := range states {
+		if s != orderRemoved {
+			o.ids = append(o.ids, ids[i])
+			o.states = append(o.states, s)
+			o.picks.push(pickable(s))
+			o.claims.push(claimable(s))
+			o.live++
+		}
+	}
+}
+
+// pick returns the id of the object at the rank given by rank out of objects which could be read
+func (o *insertionOrder) pick(rank func(n int64) int64) (uint64, bool) {
+	if o.picks.total == 0 {
+		return 0, false
+	}
+	return o.ids[o.picks.find(rank(o.picks.total))], true
+}
+
+// claim returns the id of the object at the rank given by rank out of objects which could be claimed
+func (o *insertionOrder) claim(rank func(n int64) int64) (uint64, bool) {
+	if o.claims.total == 0 {
+		return 0, false
+	}
+	return o.ids[o.claims.find(rank(o.claims.total))], true
+}
+
+// each calls fn with ids which are not removed and their states, in insertion order
+func (o *insertionOrder) each(fn func(id uint64, state uint8)) {
+	for i, s := range o.states {
+		if s != orderRemoved {
+			fn(o.ids[i], s)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package payload generates content of objects. content is a pure function of a generator
+// and the offset, so any part of an object could be generated at any time, without keeping
+// the object in memory.
+package payload
+
+import (
+	"encoding/binary"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/randstr"
+)
+
+// Generator produces content of an object
+type Generator interface {
+	// Fill writes content at offset off of the object into p
+	Fill(p []byte, off int64)
+}
+
+// Zeros is an object of all zero bytes
+type Zeros struct{}
+
+// Fill implements Generator
+func (Zeros) Fill(p []byte, off int64) {
+	for i := range p {
+		p[i] = 0
+	}
+}
+
+// Random is an incompressible stream keyed by Seed. each 8 bytes word is a hash of the seed
+// and the word index, so it is cheap to generate at any offset and unique per seed.
+type Random struct {
+	Seed uint64
+}
+
+func (r Random) word(w int64) uint64 {
+	return randstr.Splitmix(r.Seed + uint64(w+1)*randstr.SplitmixGamma)
+}
+
+// Fill implements Generator
+func (r Random) Fill(p []byte, off int64) {
+	w := off >> 3
+	// unaligned head
+	if head := int(off & 7); head != 0 {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], r.word(w))
+		n := copy(p, b[head:])
+		p = p[n:]
+		w++
+	}
+	for len(p) >= 8 {
+		binary.LittleEndian.PutUint64(p, r.word(w))
+		p = p[8:]
+		w++
+	}
+	// tail
+	if len(p) > 0 {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], r.word(w))
+		copy(p, b[:])
+	}
+}
+
+// Shared repeats the same buffer over and over, so every object has the same bytes at the
+// same offsets
+type Shared struct {
+	buf []byte
+}
+
+// NewShared returns a shared buffer of size bytes generated from seed
+func NewShared(seed uint64, size int) *Shared {
+	s := &Shared{buf: make([]byte, size)}
+	Random{Seed: seed}.Fill(s.buf, 0)
+	return s
+}
+
+// Fill implements Generator
+func (s *Shared) Fill(p []byte, off int64) {
+	size := int64(len(s.buf))
+	for len(p) > 0 {
+		n := copy(p, s.buf[off%size:])
+		p = p[n:]
+		off += int64(n)
+	}
+}
+
+// compressBlockSize is the unit Compressible lays out random bytes and zeros in. it is well
+// within windows of common compressors.
+const compressBlockSize = 4096
+
+// Compressible makes Source compress by about Ratio. the beginning of each block comes from
+// Source, the rest of the block is zeros.
+type Compressible struct {
+	Ratio  float64
+	Source Generator
+}
+
+// Fill implements Generator
+func (c Compressible) Fill(p []byte, off int64) {
+	random := int64(compressBlockSize / c.Ratio)
+	for len(p) > 0 {
+		inBlock := off % compressBlockSize
+		n := int64(len(p))
+		if rest := compressBlockSize - inBlock; n > rest {
+			n = rest
+		}
+		part := p[:n]
+		if inBlock < random {
+			k := random - inBlock
+			if k > n {
+				k = n
+			}
+			c.Source.Fill(part[:k], off)
+			part = part[k:]
+		}
+		Zeros{}.Fill(part, 0)
+		p = p[n:]
+		off += n
+	}
+}
+
+// Dedup makes about 1 - 1/Ratio of blocks duplicates. a duplicate block is one of PoolBlocks
+// blocks of Pool, so the same blocks appear in many objects. other blocks come from Unique.
+// which blocks are duplicates is decided by a hash of Seed and the block index.
+type Dedup struct {
+	Ratio      float64
+	BlockSize  int64
+	PoolBlocks int64
+	Seed       uint64
+	Unique     Generator
+	Pool       Generator
+}
+
+// Fill implements Generator
+func (d Dedup) Fill(p []byte, off int64) {
+	// fraction of unique blocks
+	unique := 1 / d.Ratio
+	for len(p) > 0 {
+		block := off / d.BlockSize
+		inBlock := off % d.BlockSize
+		n := int64(len(p))
+		if rest := d.BlockSize - inBlock; n > rest {
+			n = rest
+		}
+		h := randstr.Splitmix(d.Seed ^ uint64(block)*randstr.SplitmixGamma)
+		if float64(h)/(1<<64) < unique {
+			d.Unique.Fill(p[:n], off)
+		} else {
+			d.Pool.Fill(p[:n], int64(h%uint64(d.PoolBlocks))*d.BlockSize+inBlock)
+		}
+		p = p[n:]
+		off += n
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package payload
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// size of chunks WriteTo generates content in
+const writeChunkSize = 256 << 10
+
+var chunkPool = sync.Pool{New: func() interface{} { return make([]byte, writeChunkSize) }}
+
+// Reader reads an object, or a section of it, from a Generator. besides io.ReadSeeker, it
+// implements io.ReaderAt and io.WriterTo, so the SDK or a copy could take content without
+// extra buffering, and parts of an object could be read in parallel.
+type Reader struct {
+	gen  Generator
+	base int64 // offset of the section in the object
+	size int64
+	pos  int64
+}
+
+// NewReader returns a reader of an object of size bytes generated by gen
+func NewReader(gen Generator, size int64) *Reader {
+	return &Reader{gen: gen, size: size}
+}
+
+// Section returns an independent reader of n bytes at offset off of the reader, e.g. a part
+// of a multipart upload
+func (r *Reader) Section(off, n int64) *Reader {
+	if off < 0 || off > r.size {
+		off = r.size
+	}
+	if n < 0 || n > r.size-off {
+		n = r.size - off
+	}
+	return &Reader{gen: r.gen, base: r.base + off, size: n}
+}
+
+// Size returns the number of bytes of the reader
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Len returns the number of bytes of the unread portion
+func (r *Reader) Len() int {
+	if r.pos >= r.size {
+		return 0
+	}
+	return int(r.size - r.pos)
+}
+
+// Read implements io.Reader
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if rest := r.size - r.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	r.gen.Fill(p, r.base+r.pos)
+	r.pos += int64(len(p))
+	return len(p), nil
+}
+
+// ReadAt implements io.ReaderAt
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("payload.Reader.ReadAt: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var err error
+	if rest := r.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+		err = io.EOF
+	}
+	r.gen.Fill(p, r.base+off)
+	return len(p), err
+}
+
+// WriteTo implements io.WriterTo
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	chunk := chunkPool.Get().([]byte)
+	defer chunkPool.Put(chunk)
+	var written int64
+	for r.pos < r.size {
+		n, _ := r.Read(chunk)
+		k, err := w.Write(chunk[:n])
+		written += int64(k)
+		if err != nil {
+			return written, err
+		}
+		if k != n {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// Seek implements io.Seeker
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.pos + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("payload.Reader.Seek: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("payload.Reader.Seek: negative position")
+	}
+	r.pos = abs
+	return abs, nil
+}
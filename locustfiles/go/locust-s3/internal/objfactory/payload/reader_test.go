@@ -0,0 +1,121 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package payload
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+// the shared buffer is 8MiB in objfactory
+const sharedBufferSize = 8 << 20
+
+// reads across the end of the shared buffer used to come back short
+func TestReaderAcrossSharedBuffer(t *testing.T) {
+	gen := NewShared(1, 1024)
+	want := make([]byte, 4096)
+	for i := range want {
+		want[i] = gen.buf[i%1024]
+	}
+	r := NewReader(gen, int64(len(want)))
+	r.Seek(1000, io.SeekStart)
+	p := make([]byte, 100)
+	if n, err := r.Read(p); n != 100 || err != nil || !bytes.Equal(p, want[1000:1100]) {
+		t.Fatalf("read across buffer end got %d bytes with %v", n, err)
+	}
+	section := r.Section(2000, 2096)
+	var b bytes.Buffer
+	if n, err := section.WriteTo(&b); n != 2096 || err != nil || !bytes.Equal(b.Bytes(), want[2000:]) {
+		t.Fatalf("section got %d bytes with %v", n, err)
+	}
+	if n, err := r.ReadAt(p, 4050); n != 46 || err != io.EOF || !bytes.Equal(p[:n], want[4050:]) {
+		t.Fatalf("read at the end got %d bytes with %v", n, err)
+	}
+}
+
+func benchmarkRead(b *testing.B, gen Generator) {
+	const size = 64 << 20
+	p := make([]byte, 1<<20)
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		r := NewReader(gen, size)
+		for {
+			if _, err := r.Read(p); err == io.EOF {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkReadShared(b *testing.B) {
+	benchmarkRead(b, NewShared(1, sharedBufferSize))
+}
+
+func BenchmarkReadRandom(b *testing.B) {
+	benchmarkRead(b, Random{Seed: 1})
+}
+
+func BenchmarkReadZeros(b *testing.B) {
+	benchmarkRead(b, Zeros{})
+}
+
+func BenchmarkReadCompressible(b *testing.B) {
+	benchmarkRead(b, Compressible{Ratio: 2, Source: Random{Seed: 1}})
+}
+
+func BenchmarkReadDedup(b *testing.B) {
+	benchmarkRead(b, Dedup{Ratio: 2, BlockSize: 4096, PoolBlocks: 1024, Seed: 1,
+		Unique: Random{Seed: 1}, Pool: Random{Seed: 2}})
+}
+
+func BenchmarkWriteToShared(b *testing.B) {
+	const size = 64 << 20
+	gen := NewShared(1, sharedBufferSize)
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		NewReader(gen, size).WriteTo(ioutil.Discard)
+	}
+}
+
+func BenchmarkWriteToRandom(b *testing.B) {
+	const size = 64 << 20
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		NewReader(Random{Seed: 1}, size).WriteTo(ioutil.Discard)
+	}
+}
+
+// parts of one object read in parallel, as parts of a multipart upload are
+func BenchmarkSectionsParallel(b *testing.B) {
+	const parts, partSize = 8, 16 << 20
+	r := NewReader(Random{Seed: 1}, parts*partSize)
+	b.SetBytes(parts * partSize)
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for part := int64(0); part < parts; part++ {
+			wg.Add(1)
+			go func(part int64) {
+				defer wg.Done()
+				r.Section(part*partSize, partSize).WriteTo(ioutil.Discard)
+			}(part)
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package payload
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// size of chunks content is compared in
+const verifyChunkSize = 64 << 10
+
+// MismatchError reports the first byte which differs from the generated content
+type MismatchError struct {
+	Offset   int64
+	Got      byte
+	Expected byte
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("content mismatch at offset %d, got 0x%02x but expect 0x%02x", e.Offset, e.Got, e.Expected)
+}
+
+// Verify reads r to the end and compares it byte for byte with content of gen, starting at
+// offset off of the object. it returns number of bytes read, and a *MismatchError at the
+// first byte which differs.
+func Verify(r io.Reader, gen Generator, off int64) (int64, error) {
+	got := make([]byte, verifyChunkSize)
+	expected := make([]byte, verifyChunkSize)
+	var n int64
+	for {
+		k, err := io.ReadFull(r, got)
+		if k > 0 {
+			gen.Fill(expected[:k], off+n)
+			if !bytes.Equal(got[:k], expected[:k]) {
+				for i := 0; i < k; i++ {
+					if got[i] != expected[i] {
+						return n + int64(i), &MismatchError{Offset: off + n + int64(i), Got: got[i], Expected: expected[i]}
+					}
+				}
+			}
+			n += int64(k)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+)
+
+// objectSize samples the size of a new object
+var objectSize func(r *rand.Rand) int64
+
+func init() {
+	objectSize = newObjectSize()
+}
+
+// newObjectSize returns a sampler of the configured size distribution
+func newObjectSize() func(r *rand.Rand) int64 {
+	d := config.LoadConf.Data.SizeDistribution
+	var sample func(r *rand.Rand) float64
+	switch d.Type {
+	case config.SizeFixed:
+		sample = func(r *rand.Rand) float64 { return float64(d.Size) }
+	case config.SizeLogNormal:
+		mu := math.Log(d.Median)
+		sample = func(r *rand.Rand) float64 { return math.Exp(mu + d.Sigma*r.NormFloat64()) }
+	case config.SizePareto:
+		sample = func(r *rand.Rand) float64 {
+			// 1 - Float64() is in (0, 1], so there is no division by zero
+			return d.Scale / math.Pow(1-r.Float64(), 1/d.Shape)
+		}
+	case config.SizeExponential:
+		sample = func(r *rand.Rand) float64 { return r.ExpFloat64() * d.Mean }
+	case config.SizeEmpirical:
+		h := loadHistogram(d.Histogram)
+		sample = h.sample
+	default:
+		return objSizeViaPolicy
+	}
+	return func(r *rand.Rand) int64 {
+		size := sample(r)
+		if size > math.MaxInt64/2 {
+			size = math.MaxInt64 / 2
+		}
+		return clampSize(int64(size), d.Min, d.Max)
+	}
+}
+
+// clampSize limits size to [min, max]. max of 0 means no limit.
+func clampSize(size, min, max int64) int64 {
+	if size < min {
+		return min
+	}
+	if max > 0 && size > max {
+		return max
+	}
+	return size
+}
+
+// SampleSize returns the size of a new object, e.g. to preview the configured distribution
+func SampleSize(r *rand.Rand) int64 {
+	return objectSize(r)
+}
+
+// histogram is an empirical size distribution. sizes are uniform within each bin.
+type histogram struct {
+	low, high []int64
+	cumulated []int64 // cumulated counts of bins
+}
+
+// loadHistogram reads bins of low,high,count from a CSV file, where sizes of a bin are in
+// [low, high). a header line and # comments are allowed.
+func loadHistogram(path string) *histogram {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("failed to open size histogram %s with %s", path, err.Error())
+	}
+	defer f.Close()
+
+	h := &histogram{}
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 3
+	reader.Comment = '#'
+	var total int64
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("invalid size histogram %s with %s", path, err.Error())
+		}
+		var values [3]int64
+		for i, field := range record {
+			if values[i], err = strconv.ParseInt(field, 10, 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			if line == 1 {
+				// header
+				continue
+			}
+			log.Fatalf("invalid size histogram %s at line %d, expect low,high,count", path, line)
+		}
+		low, high, count := values[0], values[1], values[2]
+		if low < 0 || high < low || count < 0 {
+			log.Fatalf("invalid bin %d,%d,%d of size histogram %s at line %d", low, high, count, path, line)
+		}
+		if count == 0 {
+			continue
+		}
+		total += count
+		h.low = append(h.low, low)
+		h.high = append(h.high, high)
+		h.cumulated = append(h.cumulated, total)
+	}
+	if total == 0 {
+		log.Fatalf("size histogram %s has no object", path)
+	}
+	return h
+}
+
+func (h *histogram) sample(r *rand.Rand) float64 {
+	n := r.Int63n(h.cumulated[len(h.cumulated)-1])
+	i := sort.Search(len(h.cumulated), func(i int) bool { return h.cumulated[i] > n })
+	if h.high[i] == h.low[i] {
+		return float64(h.low[i])
+	}
+	return float64(h.low[i] + r.Int63n(h.high[i]-h.low[i]))
+}
+
+// SizeDistribution describes the configured size distribution
+func SizeDistribution() string {
+	d := config.LoadConf.Data.SizeDistribution
+	switch d.Type {
+	case config.SizeFixed:
+		return fmt.Sprintf("fixed %d bytes", d.Size)
+	case config.SizeLogNormal:
+		return fmt.Sprintf("log-normal with median %.0f bytes and sigma %g", d.Median, d.Sigma)
+	case config.SizePareto:
+		return fmt.Sprintf("pareto with scale %.0f bytes and shape %g", d.Scale, d.Shape)
+	case config.SizeExponential:
+		return fmt.Sprintf("exponential with mean %.0f bytes", d.Mean)
+	case config.SizeEmpirical:
+		return fmt.Sprintf("empirical of %s", d.Histogram)
+	default:
+		return fmt.Sprintf("weighted ranges with %s sizing", config.LoadConf.Data.SizingOption)
+	}
+}
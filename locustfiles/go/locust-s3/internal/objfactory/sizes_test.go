@@ -0,0 +1,98 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package objfactory
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+)
+
+func TestClampSize(t *testing.T) {
+	tests := []struct {
+		size, min, max, want int64
+	}{
+		{10, 0, 0, 10},
+		{10, 20, 0, 20},
+		{10, 0, 5, 5},
+		{10, 5, 20, 10},
+		{math.MaxInt64 / 2, 0, 0, math.MaxInt64 / 2},
+	}
+	for _, tt := range tests {
+		if got := clampSize(tt.size, tt.min, tt.max); got != tt.want {
+			t.Errorf("clampSize(%d, %d, %d) = %d, expect %d", tt.size, tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+// a quarter of objects in [0, 100), the rest in [1000, 2000), so the median is 1333
+const testHistogram = `# sizes of a bucket
+low,high,count
+0,100,1
+1000,2000,3
+5000,6000,0
+`
+
+func TestSizeDistribution(t *testing.T) {
+	histogram := filepath.Join(t.TempDir(), "sizes.csv")
+	if err := ioutil.WriteFile(histogram, []byte(testHistogram), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		typ                         string
+		size                        int64
+		median, sigma, scale, shape float64
+		mean                        float64
+		min, max                    int64
+		// sizes sampled are in [low, high], with a median close to the one expected
+		low, high    int64
+		expectMedian float64
+	}{
+		{typ: config.SizeFixed, size: 4096, low: 4096, high: 4096, expectMedian: 4096},
+		{typ: config.SizeLogNormal, median: 1 << 20, sigma: 1, low: 0, high: math.MaxInt64, expectMedian: 1 << 20},
+		{typ: config.SizeLogNormal, median: 1000, sigma: 3, min: 100, max: 10000, low: 100, high: 10000, expectMedian: 1000},
+		{typ: config.SizePareto, scale: 1000, shape: 1.5, low: 1000, high: math.MaxInt64, expectMedian: 1000 * math.Pow(2, 1/1.5)},
+		{typ: config.SizeExponential, mean: 1000, low: 0, high: math.MaxInt64, expectMedian: 1000 * math.Ln2},
+		{typ: config.SizeEmpirical, low: 0, high: 1999, expectMedian: 1333},
+	}
+	d := &config.LoadConf.Data.SizeDistribution
+	saved := *d
+	defer func() { *d = saved }()
+	for _, tt := range tests {
+		d.Type, d.Size, d.Histogram = tt.typ, tt.size, histogram
+		d.Median, d.Sigma, d.Scale, d.Shape, d.Mean = tt.median, tt.sigma, tt.scale, tt.shape, tt.mean
+		d.Min, d.Max = tt.min, tt.max
+		sample := newObjectSize()
+		r := rand.New(rand.NewSource(1))
+		sizes := make([]int64, 20000)
+		for i := range sizes {
+			sizes[i] = sample(r)
+			if sizes[i] < tt.low || sizes[i] > tt.high {
+				t.Fatalf("%s sampled %d out of [%d, %d]", tt.typ, sizes[i], tt.low, tt.high)
+			}
+		}
+		sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+		if median := float64(sizes[len(sizes)/2]); math.Abs(median-tt.expectMedian) > 0.05*tt.expectMedian {
+			t.Errorf("%s has median %.0f, expect %.0f", tt.typ, median, tt.expectMedian)
+		}
+	}
+}
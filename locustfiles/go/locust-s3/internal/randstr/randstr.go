@@ -18,14 +18,76 @@ package randstr
 
 import (
 	"math/rand"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Seed of this runner, given to Init
+var Seed int64
+
+// Default is the random generator shared by all virtual users. it is seeded again by Init.
+var Default = New(time.Now().UnixNano())
+
+// Init seeds Default with seed, or current time if seed is 0, and returns the seed in use.
+// it should be called once, before any other use of the package.
+func Init(seed int64) int64 {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	Seed = seed
+	Default.Seed(seed)
+	return seed
+}
+
+// SplitmixGamma is the golden ratio increment of splitmix64
+const SplitmixGamma = 0x9e3779b97f4a7c15
+
+// Splitmix is the output function of splitmix64, a cheap hash of a 64 bits word
+func Splitmix(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// lockedSource is a splitmix64 generator. unlike sources of math/rand, it is safe for
+// concurrent use, and it is cheap to create one for every object.
+type lockedSource struct {
+	sync.Mutex
+	state uint64
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.Lock()
+	s.state += SplitmixGamma
+	z := s.state
+	s.Unlock()
+	return Splitmix(z)
+}
+
+func (s *lockedSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.Lock()
+	s.state = uint64(seed)
+	s.Unlock()
+}
+
+// New returns a random generator of seed, which is safe for concurrent use except Read
+func New(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{state: uint64(seed)})
+}
+
+// Mix derives the seed of stream i out of seed, so streams of the same seed do not overlap
+func Mix(seed int64, i int64) int64 {
+	return int64(Splitmix(uint64(seed) + uint64(i)*SplitmixGamma))
+}
+
 // original code comes from https://github.com/kpbird/golang_random_string
 // this will be much faster than a uuid based string
 
-var src = rand.NewSource(time.Now().UnixNano())
-
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 const (
 	letterIdxBits = 6                    // 6 bits to represent a letter index
@@ -33,13 +95,13 @@ const (
 	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
-// RandStringBytesMaskImprSrc return a random string with length n
-func RandStringBytesMaskImprSrc(n int) string {
+// Letters return a random string of n letters generated by r
+func Letters(r *rand.Rand, n int) string {
 	b := make([]byte, n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
+	// A r.Int63() generates 63 random bits, enough for letterIdxMax characters!
+	for i, cache, remain := n-1, r.Int63(), letterIdxMax; i >= 0; {
 		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+			cache, remain = r.Int63(), letterIdxMax
 		}
 		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
 			b[i] = letterBytes[idx]
@@ -51,3 +113,17 @@ func RandStringBytesMaskImprSrc(n int) string {
 
 	return string(b)
 }
+
+// RandStringBytesMaskImprSrc return a random string with length n
+func RandStringBytesMaskImprSrc(n int) string {
+	return Letters(Default, n)
+}
+
+// RandStringFrom returns a random string of n characters picked from charset by r
+func RandStringFrom(r *rand.Rand, n int, charset []rune) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteRune(charset[r.Intn(len(charset))])
+	}
+	return b.String()
+}
@@ -19,10 +19,10 @@ package main
 import (
 	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
@@ -80,7 +80,11 @@ func initS3Client() *s3.S3 {
 func initBuckets() {
 	if config.LoadConf.Data.CreateBucketOnStart {
 		for _, b := range config.LoadConf.Data.Buckets {
-			if _, err := sharedServiceClient.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(b)}); err != nil {
+			input := &s3.CreateBucketInput{Bucket: aws.String(b)}
+			if config.LoadConf.Data.ObjectLock.Enabled {
+				input.ObjectLockEnabledForBucket = aws.Bool(true)
+			}
+			if _, err := sharedServiceClient.CreateBucket(input); err != nil {
 				if aerr, ok := err.(awserr.Error); ok {
 					switch aerr.Code() {
 					case s3.ErrCodeBucketAlreadyOwnedByYou:
@@ -89,9 +93,19 @@ func initBuckets() {
 						panic(aerr.Error())
 					}
 				}
+			} else if buckets, ok := objfactory.ObjectCatalog().(objfactory.BucketCatalog); ok {
+				// only buckets created here are removed by cleanup
+				if err := buckets.AddBucket(b); err != nil {
+					fmt.Printf("failed to record bucket %s in catalog with %s\n", b, err.Error())
+				}
 			}
 		}
 	}
+	if config.LoadConf.Data.ObjectLock.DefaultRetention.Mode != "" {
+		for _, b := range config.LoadConf.Data.Buckets {
+			initDefaultRetention(b)
+		}
+	}
 }
 
 func getService() {
@@ -119,18 +133,10 @@ func putObject() {
 		time.Sleep(1000 * time.Millisecond)
 		return
 	}
+	obj.ObjectData = throttleUpload(obj.ObjectData)
 
 	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
-	req, _ := sharedServiceClient.PutObjectRequest(&s3.PutObjectInput{
-		Bucket:        aws.String(obj.ObjectBucket),
-		Key:           aws.String(obj.ObjectKey),
-		Body:          obj.ObjectData,
-		ContentLength: aws.Int64(int64(obj.ObjectSize)),
-		ContentType:   aws.String("binary/octet-stream"),
-	})
-	// Disable payload checksum calculation (very expensive)
-	req.HTTPRequest.Header.Add("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
-	err := req.Send()
+	err := writeObject(&obj)
 	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
 
 	if err != nil {
@@ -143,10 +149,73 @@ func putObject() {
 		if config.Verbose {
 			fmt.Printf("put object %s/%s with size %d succ\n", obj.ObjectBucket, obj.ObjectKey, obj.ObjectSize)
 		}
+		checkConsistency("putObject", &obj, true)
+	}
+	obj.ReleaseObject(err)
+}
+
+// overwriteObject uploads new content of a cached object under the same key
+func overwriteObject() {
+	var obj objfactory.ObjectSpec
+	if err := obj.GetObject(objfactory.Overwrite); err != nil {
+		if config.Verbose {
+			fmt.Println("no object for overwrite operation from cache, will sleep 1sec and retry")
+		}
+		time.Sleep(1000 * time.Millisecond)
+		return
+	}
+	obj.ObjectData = throttleUpload(obj.ObjectData)
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	err := writeObject(&obj)
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	if err != nil {
+		boomer.RecordFailure("s3", "overwriteObject", elapsed, err.Error())
+	} else {
+		boomer.RecordSuccess("s3", "overwriteObject", elapsed, obj.ObjectSize)
+		if config.Verbose {
+			fmt.Printf("overwrite object %s/%s with size %d\n", obj.ObjectBucket, obj.ObjectKey, obj.ObjectSize)
+		}
+		checkConsistency("overwriteObject", &obj, true)
 	}
 	obj.ReleaseObject(err)
 }
 
+// writeObject uploads obj and keeps what later requests need to know about it
+func writeObject(obj *objfactory.ObjectSpec) error {
+	if parts := partSections(obj); parts != nil {
+		return writeMultipart(obj, parts)
+	}
+	req, out := newPutObjectRequest(obj)
+	err := req.Send()
+	if err == nil {
+		saveObjectInfo(obj, req, out)
+	}
+	return err
+}
+
+// newPutObjectRequest prepares a PUT object request for obj
+func newPutObjectRequest(obj *objfactory.ObjectSpec) (*request.Request, *s3.PutObjectOutput) {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(obj.ObjectBucket),
+		Key:           aws.String(obj.ObjectKey),
+		Body:          obj.ObjectData,
+		ContentLength: aws.Int64(int64(obj.ObjectSize)),
+		ContentType:   aws.String("binary/octet-stream"),
+		Metadata:      aws.StringMap(obj.ObjectMetadata),
+		Tagging:       encodeTagging(obj.ObjectTags),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = serverSideEncryption()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(obj)
+	applyObjectLock(input, obj)
+
+	req, out := sharedServiceClient.PutObjectRequest(input)
+	// Disable payload checksum calculation (very expensive)
+	req.HTTPRequest.Header.Add("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	return req, out
+}
+
 func withAcceptEncoding(e string) request.Option {
 	return func(r *request.Request) {
 		r.HTTPRequest.Header.Add("Accept-Encoding", e)
@@ -164,27 +233,22 @@ func getObject() {
 	}
 
 	ctx := context.Background()
-
-	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
-	resp, err := sharedServiceClient.GetObjectWithContext(ctx, &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(obj.ObjectBucket),
 		Key:    aws.String(obj.ObjectKey),
-	}, withAcceptEncoding("identity"))
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(&obj)
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	resp, err := sharedServiceClient.GetObjectWithContext(ctx, input, withAcceptEncoding("identity"))
 	if err != nil {
 		elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
 		boomer.RecordFailure("s3", "getObject", elapsed, err.Error())
 	} else {
 		defer resp.Body.Close()
-		length, err := io.Copy(ioutil.Discard, resp.Body)
+		length, sinkTime, err := readBody(&obj, throttleDownload(resp.Body), 0, obj.ObjectSize)
 		elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
-		if err == nil {
-			boomer.RecordSuccess("s3", "getObject", elapsed, int64(length))
-			if config.Verbose {
-				fmt.Printf("get object %s/%s\n", obj.ObjectBucket, obj.ObjectKey)
-			}
-		} else {
-			boomer.RecordFailure("s3", "getObject", elapsed, fmt.Sprintf("get %s/%s failed with %s", obj.ObjectBucket, obj.ObjectKey, err.Error()))
-		}
+		recordRead("s3", "getObject", &obj, elapsed, sinkTime, length, err)
 	}
 	obj.ReleaseObject(err)
 }
@@ -200,11 +264,14 @@ func headObject() {
 		return
 	}
 
-	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
-	resp, err := sharedServiceClient.HeadObject(&s3.HeadObjectInput{
+	input := &s3.HeadObjectInput{
 		Bucket: aws.String(obj.ObjectBucket),
 		Key:    aws.String(obj.ObjectKey),
-	})
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(&obj)
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	resp, err := sharedServiceClient.HeadObject(input)
 	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
 
 	if err != nil {
@@ -218,6 +285,67 @@ func headObject() {
 	obj.ReleaseObject(err)
 }
 
+func copyObject() {
+
+	var src objfactory.ObjectSpec
+	if err := src.GetObject(objfactory.Read); err != nil {
+		if config.Verbose {
+			fmt.Println("no object for copy operation from cache, will sleep 1sec and retry")
+		}
+		time.Sleep(1000 * time.Millisecond)
+		return
+	}
+	var dst objfactory.ObjectSpec
+	dst.GetObject(objfactory.Copy)
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	err := sendCopyObject(&src, &dst)
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	if err != nil {
+		boomer.RecordFailure("s3", "copyObject", elapsed, err.Error())
+	} else {
+		boomer.RecordSuccess("s3", "copyObject", elapsed, int64(10))
+		if config.Verbose {
+			fmt.Printf("copy object %s/%s to %s/%s\n", src.ObjectBucket, src.ObjectKey, dst.ObjectBucket, dst.ObjectKey)
+		}
+	}
+	src.ReleaseObject(err)
+	dst.ReleaseObject(err)
+}
+
+// copySource returns x-amz-copy-source of src. segments of the key are escaped, but not
+// the / between them, as some endpoints do not decode %2F.
+func copySource(src *objfactory.ObjectSpec) string {
+	segments := strings.Split(src.ObjectKey, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return src.ObjectBucket + "/" + strings.Join(segments, "/")
+}
+
+// sendCopyObject copies src to dst, which is prepared by GetObject with Copy
+func sendCopyObject(src, dst *objfactory.ObjectSpec) error {
+	dst.ObjectSize = src.ObjectSize
+	dst.CopyPayload(src)
+
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(dst.ObjectBucket),
+		Key:        aws.String(dst.ObjectKey),
+		CopySource: aws.String(copySource(src)),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = serverSideEncryption()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(dst)
+	input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey = sseCustomerKey(src)
+
+	resp, err := sharedServiceClient.CopyObject(input)
+	if err == nil && config.LoadConf.Data.CacheETag && resp.CopyObjectResult != nil {
+		dst.ETag = aws.StringValue(resp.CopyObjectResult.ETag)
+		dst.LastModified = aws.TimeValue(resp.CopyObjectResult.LastModified)
+	}
+	return err
+}
+
 func deleteObject() {
 
 	var obj objfactory.ObjectSpec
@@ -243,15 +371,24 @@ func deleteObject() {
 		if config.Verbose {
 			fmt.Printf("delete object %s/%s\n", obj.ObjectBucket, obj.ObjectKey)
 		}
+		checkConsistency("deleteObject", &obj, false)
 	}
 	obj.ReleaseObject(err)
 }
 
 func main() {
+	if runCommand() {
+		return
+	}
+
 	sharedServiceClient = initS3Client()
 
 	initBuckets()
 
+	if config.LoadConf.Prepare.OnStart {
+		prepareDataset(config.LoadConf.Prepare.Objects, config.LoadConf.Prepare.Bytes, config.LoadConf.Prepare.Workers)
+	}
+
 	taskGetService := &boomer.Task{
 		Name:   "getService",
 		Weight: config.LoadConf.Ops.Weights.GetService,
@@ -272,10 +409,116 @@ func main() {
 		Weight: config.LoadConf.Ops.Weights.DeleteObject,
 		Fn:     deleteObject,
 	}
+	taskOverwriteObject := &boomer.Task{
+		Name:   "overwriteObject",
+		Weight: config.LoadConf.Ops.Weights.OverwriteObject,
+		Fn:     overwriteObject,
+	}
+	taskGetObjectRange := &boomer.Task{
+		Name:   "getObjectRange",
+		Weight: config.LoadConf.Ops.Weights.GetObjectRange,
+		Fn:     getObjectRange,
+	}
 	taskHeadObject := &boomer.Task{
 		Name:   "headObject",
 		Weight: config.LoadConf.Ops.Weights.HeadObject,
 		Fn:     headObject,
 	}
-	boomer.Run(taskGetService, taskGetObject, taskPutObject, taskDeleteObject, taskHeadObject)
+	taskCopyObject := &boomer.Task{
+		Name:   "copyObject",
+		Weight: config.LoadConf.Ops.Weights.CopyObject,
+		Fn:     copyObject,
+	}
+	taskConditionalGetObject := &boomer.Task{
+		Name:   "conditionalGetObject",
+		Weight: config.LoadConf.Ops.Weights.ConditionalGetObject,
+		Fn:     conditionalGetObject,
+	}
+	taskConditionalHeadObject := &boomer.Task{
+		Name:   "conditionalHeadObject",
+		Weight: config.LoadConf.Ops.Weights.ConditionalHeadObject,
+		Fn:     conditionalHeadObject,
+	}
+	taskConditionalPutObject := &boomer.Task{
+		Name:   "conditionalPutObject",
+		Weight: config.LoadConf.Ops.Weights.ConditionalPutObject,
+		Fn:     conditionalPutObject,
+	}
+	taskDeleteLockedObject := &boomer.Task{
+		Name:   "deleteLockedObject",
+		Weight: config.LoadConf.Ops.Weights.DeleteLockedObject,
+		Fn:     deleteLockedObject,
+	}
+	taskPutObjectTagging := &boomer.Task{
+		Name:   "putObjectTagging",
+		Weight: config.LoadConf.Ops.Weights.PutObjectTagging,
+		Fn:     putObjectTagging,
+	}
+	taskGetObjectTagging := &boomer.Task{
+		Name:   "getObjectTagging",
+		Weight: config.LoadConf.Ops.Weights.GetObjectTagging,
+		Fn:     getObjectTagging,
+	}
+	taskDeleteObjectTagging := &boomer.Task{
+		Name:   "deleteObjectTagging",
+		Weight: config.LoadConf.Ops.Weights.DeleteObjectTagging,
+		Fn:     deleteObjectTagging,
+	}
+	taskPutBucketPolicy := &boomer.Task{
+		Name:   "putBucketPolicy",
+		Weight: config.LoadConf.Ops.Weights.PutBucketPolicy,
+		Fn:     putBucketPolicy,
+	}
+	taskGetBucketPolicy := &boomer.Task{
+		Name:   "getBucketPolicy",
+		Weight: config.LoadConf.Ops.Weights.GetBucketPolicy,
+		Fn:     getBucketPolicy,
+	}
+	taskDeleteBucketPolicy := &boomer.Task{
+		Name:   "deleteBucketPolicy",
+		Weight: config.LoadConf.Ops.Weights.DeleteBucketPolicy,
+		Fn:     deleteBucketPolicy,
+	}
+	taskPutBucketAcl := &boomer.Task{
+		Name:   "putBucketAcl",
+		Weight: config.LoadConf.Ops.Weights.PutBucketAcl,
+		Fn:     putBucketAcl,
+	}
+	taskGetBucketAcl := &boomer.Task{
+		Name:   "getBucketAcl",
+		Weight: config.LoadConf.Ops.Weights.GetBucketAcl,
+		Fn:     getBucketAcl,
+	}
+	taskPutObjectAcl := &boomer.Task{
+		Name:   "putObjectAcl",
+		Weight: config.LoadConf.Ops.Weights.PutObjectAcl,
+		Fn:     putObjectAcl,
+	}
+	taskGetObjectAcl := &boomer.Task{
+		Name:   "getObjectAcl",
+		Weight: config.LoadConf.Ops.Weights.GetObjectAcl,
+		Fn:     getObjectAcl,
+	}
+	taskPutBucketCors := &boomer.Task{
+		Name:   "putBucketCors",
+		Weight: config.LoadConf.Ops.Weights.PutBucketCors,
+		Fn:     putBucketCors,
+	}
+	taskGetBucketCors := &boomer.Task{
+		Name:   "getBucketCors",
+		Weight: config.LoadConf.Ops.Weights.GetBucketCors,
+		Fn:     getBucketCors,
+	}
+	taskDeleteBucketCors := &boomer.Task{
+		Name:   "deleteBucketCors",
+		Weight: config.LoadConf.Ops.Weights.DeleteBucketCors,
+		Fn:     deleteBucketCors,
+	}
+	tasks := []*boomer.Task{taskGetService, taskGetObject, taskGetObjectRange, taskPutObject, taskOverwriteObject, taskDeleteObject, taskHeadObject, taskCopyObject,
+		taskConditionalGetObject, taskConditionalHeadObject, taskConditionalPutObject, taskDeleteLockedObject,
+		taskPutObjectTagging, taskGetObjectTagging, taskDeleteObjectTagging,
+		taskPutBucketPolicy, taskGetBucketPolicy, taskDeleteBucketPolicy,
+		taskPutBucketAcl, taskGetBucketAcl, taskPutObjectAcl, taskGetObjectAcl,
+		taskPutBucketCors, taskGetBucketCors, taskDeleteBucketCors}
+	boomer.Run(append(tasks, scenarioTasks()...)...)
 }
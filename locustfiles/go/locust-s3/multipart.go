@@ -0,0 +1,168 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory/payload"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3 allows at most this many parts in a multipart upload
+const maxParts = 10000
+
+// partSections splits content of obj into parts which could be read in parallel, or returns nil
+// if obj is uploaded with a single PUT. generated content is split into sections of its payload,
+// files of a corpus are read at offsets. throttled content could not be split.
+func partSections(obj *objfactory.ObjectSpec) []io.ReadSeeker {
+	multipart := config.LoadConf.Ops.PutObject.Multipart
+	if multipart.Threshold <= 0 || obj.ObjectSize < multipart.Threshold {
+		return nil
+	}
+	partSize := multipart.PartSize
+	if least := (obj.ObjectSize + maxParts - 1) / maxParts; partSize < least {
+		partSize = least
+	}
+	var section func(off, n int64) io.ReadSeeker
+	switch data := obj.ObjectData.(type) {
+	case *payload.Reader:
+		section = func(off, n int64) io.ReadSeeker { return data.Section(off, n) }
+	case io.ReaderAt:
+		section = func(off, n int64) io.ReadSeeker { return io.NewSectionReader(data, off, n) }
+	default:
+		return nil
+	}
+	var parts []io.ReadSeeker
+	for off := int64(0); off < obj.ObjectSize; off += partSize {
+		n := partSize
+		if rest := obj.ObjectSize - off; n > rest {
+			n = rest
+		}
+		parts = append(parts, section(off, n))
+	}
+	return parts
+}
+
+// writeMultipart uploads obj with a multipart upload of parts, concurrency parts at a time.
+// the upload is aborted if any part fails.
+func writeMultipart(obj *objfactory.ObjectSpec, parts []io.ReadSeeker) error {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(obj.ObjectBucket),
+		Key:         aws.String(obj.ObjectKey),
+		ContentType: aws.String("binary/octet-stream"),
+		Metadata:    aws.StringMap(obj.ObjectMetadata),
+		Tagging:     encodeTagging(obj.ObjectTags),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = serverSideEncryption()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(obj)
+	if lock := config.LoadConf.Data.ObjectLock; lock.Enabled {
+		if lock.Retention.Mode != "" {
+			input.ObjectLockMode = aws.String(lock.Retention.Mode)
+			input.ObjectLockRetainUntilDate = aws.Time(obj.RetainUntil)
+		}
+		if obj.LegalHold {
+			input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+		}
+	}
+	upload, err := sharedServiceClient.CreateMultipartUpload(input)
+	if err != nil {
+		return err
+	}
+
+	completed := make([]*s3.CompletedPart, len(parts))
+	numbers := make(chan int)
+	var once sync.Once
+	var partErr error
+	var wg sync.WaitGroup
+	for i := 0; i < config.LoadConf.Ops.PutObject.Multipart.Concurrency && i < len(parts); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range numbers {
+				etag, err := uploadPart(obj, upload.UploadId, int64(n+1), parts[n])
+				if err != nil {
+					once.Do(func() { partErr = err })
+					continue
+				}
+				completed[n] = &s3.CompletedPart{ETag: etag, PartNumber: aws.Int64(int64(n + 1))}
+			}
+		}()
+	}
+	for n := range parts {
+		numbers <- n
+	}
+	close(numbers)
+	wg.Wait()
+
+	if partErr == nil {
+		req, out := sharedServiceClient.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(obj.ObjectBucket),
+			Key:             aws.String(obj.ObjectKey),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		})
+		if partErr = req.Send(); partErr == nil {
+			saveObjectInfo(obj, req, &s3.PutObjectOutput{ETag: out.ETag, VersionId: out.VersionId})
+			return nil
+		}
+	}
+	// parts already uploaded take space until the upload is aborted
+	sharedServiceClient.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(obj.ObjectBucket),
+		Key:      aws.String(obj.ObjectKey),
+		UploadId: upload.UploadId,
+	})
+	return partErr
+}
+
+// uploadPart uploads one part read from body, and returns its ETag
+func uploadPart(obj *objfactory.ObjectSpec, uploadID *string, number int64, body io.ReadSeeker) (*string, error) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = body.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.UploadPartInput{
+		Bucket:        aws.String(obj.ObjectBucket),
+		Key:           aws.String(obj.ObjectKey),
+		UploadId:      uploadID,
+		PartNumber:    aws.Int64(number),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(obj)
+	// object lock needs Content-MD5 on every part as on a single PUT
+	if config.LoadConf.Data.ObjectLock.Enabled {
+		if md5, err := md5Of(body); err == nil {
+			input.ContentMD5 = aws.String(md5)
+		}
+	}
+	req, out := sharedServiceClient.UploadPartRequest(input)
+	req.HTTPRequest.Header.Add("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	return out.ETag, nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// status a delete of an object version could return with object lock
+var lockStatus = []int{http.StatusOK, http.StatusForbidden}
+
+// retain until dates are from the client clock, and default retention starts on the server when
+// upload finishes. deletes this close to retain until could go either way, so they are skipped.
+const retentionTolerance = time.Minute
+
+var errNearRetention = errors.New("too close to retain until date")
+
+// withContentMD5 sets Content-MD5 of body, which object lock requests are rejected without.
+// body of the request is used if body is nil.
+func withContentMD5(body io.ReadSeeker) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Build.PushBack(func(r *request.Request) {
+			if r.Error != nil {
+				return
+			}
+			b := body
+			if b == nil {
+				b = r.Body
+			}
+			sum, err := md5Of(b)
+			if err != nil {
+				r.Error = err
+				return
+			}
+			r.HTTPRequest.Header.Set("Content-Md5", sum)
+		})
+	}
+}
+
+// md5Of returns the base64 MD5 of body, and rewinds body
+func md5Of(body io.ReadSeeker) (string, error) {
+	h := md5.New()
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// initDefaultRetention sets the default retention of a bucket with object lock enabled
+func initDefaultRetention(bucket string) {
+	retention := &config.LoadConf.Data.ObjectLock.DefaultRetention
+	_, err := sharedServiceClient.PutObjectLockConfigurationWithContext(context.Background(), &s3.PutObjectLockConfigurationInput{
+		Bucket: aws.String(bucket),
+		ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+			ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+			Rule: &s3.ObjectLockRule{
+				DefaultRetention: &s3.DefaultRetention{
+					Mode: aws.String(retention.Mode),
+					Days: aws.Int64(retention.Days),
+				},
+			},
+		},
+	}, withContentMD5(nil))
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// applyObjectLock adds per object retention and legal hold to an upload
+func applyObjectLock(input *s3.PutObjectInput, obj *objfactory.ObjectSpec) {
+	lock := &config.LoadConf.Data.ObjectLock
+	if !lock.Enabled {
+		return
+	}
+	// content is read one more time for it. a body which could not be read fails the upload anyway.
+	if md5, err := md5Of(unthrottled(obj.ObjectData)); err == nil {
+		input.ContentMD5 = aws.String(md5)
+	}
+	if lock.Retention.Mode != "" {
+		input.ObjectLockMode = aws.String(lock.Retention.Mode)
+		input.ObjectLockRetainUntilDate = aws.Time(obj.RetainUntil)
+	}
+	if obj.LegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+}
+
+// deleteLockedObject tries to delete the uploaded version of a cached object. the delete
+// must be rejected while the version is under retention or legal hold, and must succeed after.
+func deleteLockedObject() {
+	var obj objfactory.ObjectSpec
+	if err := obj.GetObject(objfactory.Delete); err != nil || obj.VersionID == "" {
+		if config.Verbose {
+			fmt.Println("no versioned object for delete locked operation from cache, will sleep 1sec and retry")
+		}
+		time.Sleep(1000 * time.Millisecond)
+		return
+	}
+
+	if !obj.LegalHold && absDuration(time.Until(obj.RetainUntil)) < retentionTolerance {
+		obj.ReleaseObject(errNearRetention)
+		return
+	}
+	name, expected := "deleteLockedObject-expired", http.StatusOK
+	if obj.Locked() {
+		name, expected = "deleteLockedObject-locked", http.StatusForbidden
+	}
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	_, err := sharedServiceClient.DeleteObject(&s3.DeleteObjectInput{
+		Bucket:    aws.String(obj.ObjectBucket),
+		Key:       aws.String(obj.ObjectKey),
+		VersionId: aws.String(obj.VersionID),
+	})
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	recordExpectedStatus(name, &obj, expected, lockStatus, elapsed, int64(10), err)
+	if err == nil {
+		forgetConsistency(&obj)
+	}
+	if config.Verbose {
+		fmt.Printf("%s object %s/%s version %s with status %d\n",
+			name, obj.ObjectBucket, obj.ObjectKey, obj.VersionID, statusCode(err))
+	}
+	// the version is gone from the cache only if it is really deleted
+	obj.ReleaseObject(err)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+)
+
+// prepare stops once this many uploads failed, e.g. the endpoint is down
+const maxPrepareFailures = 100
+
+// how often progress of prepare is reported
+const prepareReportInterval = 10 * time.Second
+
+// dataset tracks progress of prepare. objects and bytes are reserved by workers before
+// each upload, and given back if the upload fails. with a catalog shared by runners, e.g.
+// prepare.on_start of many runners, room is reserved in the catalog instead, and objects
+// and bytes only count uploads of this runner.
+type dataset struct {
+	targetObjects int64
+	targetBytes   int64
+	objects       int64
+	bytes         int64
+	failed        int64
+	shared        objfactory.SharedDataset
+}
+
+// reserve claims room for one more object of size, and returns false once the target is reached.
+// the reservation is only known by a shared catalog.
+func (d *dataset) reserve(size int64) (string, bool) {
+	if d.shared != nil {
+		reservation, err := d.shared.Reserve(size, d.targetObjects, d.targetBytes)
+		if err != nil {
+			fmt.Printf("failed to reserve room of dataset in catalog with %s\n", err.Error())
+			atomic.AddInt64(&d.failed, 1)
+			return "", false
+		}
+		if reservation != "" {
+			atomic.AddInt64(&d.objects, 1)
+			atomic.AddInt64(&d.bytes, size)
+		}
+		return reservation, reservation != ""
+	}
+	objects := atomic.AddInt64(&d.objects, 1)
+	bytes := atomic.AddInt64(&d.bytes, size)
+	// the last object is allowed to cross the target of bytes
+	if (d.targetObjects > 0 && objects > d.targetObjects) || (d.targetBytes > 0 && bytes-size >= d.targetBytes) {
+		d.giveBack(size, "")
+		return "", false
+	}
+	return "", true
+}
+
+func (d *dataset) giveBack(size int64, reservation string) {
+	atomic.AddInt64(&d.objects, -1)
+	atomic.AddInt64(&d.bytes, -size)
+	d.unreserve(reservation)
+}
+
+// unreserve gives room back to a shared catalog. an uploaded object gives it back before it
+// is added, so the catalog could overshoot by at most one object per worker, but never stops short.
+func (d *dataset) unreserve(reservation string) {
+	if d.shared == nil {
+		return
+	}
+	if err := d.shared.Unreserve(reservation); err != nil {
+		fmt.Printf("failed to give back room of dataset in catalog with %s\n", err.Error())
+	}
+}
+
+// prepare writes a dataset into the object catalog before measuring, so reads do not start
+// from an empty catalog
+func prepare(args []string) {
+	fs := flag.NewFlagSet("prepare", flag.ExitOnError)
+	objects := fs.Int64("objects", config.LoadConf.Prepare.Objects, "number of objects in the dataset")
+	bytes := fs.Int64("bytes", config.LoadConf.Prepare.Bytes, "number of bytes in the dataset")
+	workers := fs.Int("workers", config.LoadConf.Prepare.Workers, "number of concurrent uploads")
+	fs.Parse(args)
+
+	if *objects <= 0 && *bytes <= 0 {
+		log.Fatalln("a target number of objects or bytes is needed")
+	}
+	if *workers <= 0 {
+		log.Fatalf("invalid number of workers %d", *workers)
+	}
+	mustCatalog()
+	// memory cache is gone with this process, the dataset would be unknown to runners
+	if config.LoadConf.Cache.Type == config.CacheMemory {
+		log.Fatalln("prepare command needs a redis or disk cache, or use prepare.on_start with memory cache")
+	}
+
+	sharedServiceClient = initS3Client()
+	initBuckets()
+	prepareDataset(*objects, *bytes, *workers)
+}
+
+// prepareDataset uploads objects with the configured sizes at full speed until the catalog
+// holds the target number of objects or bytes. objects already in the catalog count toward
+// the target, so running it again only tops the dataset up.
+func prepareDataset(targetObjects, targetBytes int64, workers int) {
+	// keys of corpus files repeat, a file uploaded again does not grow the dataset
+	corpusObjects, corpusBytes, keyFromPath := objfactory.CorpusDataset()
+	if keyFromPath && (targetObjects > corpusObjects || targetBytes > corpusBytes) {
+		log.Fatalf("corpus with key_from_path makes at most %d objects and %d bytes, less than the target",
+			corpusObjects, corpusBytes)
+	}
+	catalog := mustCatalog()
+	d := &dataset{targetObjects: targetObjects, targetBytes: targetBytes}
+	existingObjects, existingBytes := existingDataset(catalog)
+	fmt.Printf("prepare dataset of %d objects and %d bytes, %d objects and %d bytes exist\n",
+		targetObjects, targetBytes, existingObjects, existingBytes)
+	if shared, ok := catalog.(objfactory.SharedDataset); ok {
+		d.shared = shared
+	} else {
+		d.objects, d.bytes = existingObjects, existingBytes
+	}
+	startObjects, startBytes := d.objects, d.bytes
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(prepareReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				seconds := time.Since(start).Seconds()
+				objects, bytes := atomic.LoadInt64(&d.objects), atomic.LoadInt64(&d.bytes)
+				fmt.Printf("prepared %d objects and %d bytes, %.1f objects/s, %.1f MiB/s\n", objects, bytes,
+					float64(objects-startObjects)/seconds, float64(bytes-startBytes)/seconds/(1<<20))
+			}
+		}
+	}()
+
+	for {
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.fill()
+			}()
+		}
+		wg.Wait()
+		// uploads of a corpus file again are counted as new objects, so count the catalog and
+		// go on until it really holds the target. a shared catalog counts objects it holds already.
+		if !keyFromPath || d.shared != nil || d.failed >= maxPrepareFailures {
+			break
+		}
+		objects, bytes := existingDataset(catalog)
+		if (targetObjects > 0 && objects >= targetObjects) || (targetBytes > 0 && bytes >= targetBytes) {
+			break
+		}
+		atomic.StoreInt64(&d.objects, objects)
+		atomic.StoreInt64(&d.bytes, bytes)
+	}
+	close(done)
+
+	if d.failed >= maxPrepareFailures {
+		log.Fatalf("prepare stopped after %d failed uploads", d.failed)
+	}
+	if d.shared != nil {
+		fmt.Printf("uploaded %d objects and %d bytes\n", d.objects, d.bytes)
+	}
+	if d.shared != nil || keyFromPath {
+		d.objects, d.bytes = existingDataset(catalog)
+	}
+	fmt.Printf("dataset ready with %d objects and %d bytes in %s, %d uploads failed\n",
+		d.objects, d.bytes, time.Since(start).Round(time.Second), d.failed)
+}
+
+// fill uploads objects until the dataset is complete
+func (d *dataset) fill() {
+	for atomic.LoadInt64(&d.failed) < maxPrepareFailures {
+		var obj objfactory.ObjectSpec
+		if err := obj.GetObject(objfactory.Write); err != nil {
+			log.Fatalf("failed to generate object with %s", err.Error())
+		}
+		reservation, ok := d.reserve(obj.ObjectSize)
+		if !ok {
+			return
+		}
+		err := writeObject(&obj)
+		if err == nil {
+			d.unreserve(reservation)
+		} else {
+			d.giveBack(obj.ObjectSize, reservation)
+			atomic.AddInt64(&d.failed, 1)
+			if config.Verbose {
+				fmt.Printf("prepare object %s/%s failed with %s\n", obj.ObjectBucket, obj.ObjectKey, err.Error())
+			}
+		}
+		obj.ReleaseObject(err)
+	}
+}
+
+// existingDataset returns number of objects and bytes already in the catalog. bytes are only
+// known by catalogs that keep stats of runs.
+func existingDataset(catalog objfactory.Catalog) (objects, bytes int64) {
+	objects, err := catalog.Count()
+	if err != nil {
+		log.Fatalf("failed to count objects in catalog with %s", err.Error())
+	}
+	runs, ok := catalog.(objfactory.RunCatalog)
+	if !ok {
+		return objects, 0
+	}
+	infos, err := runs.Runs()
+	if err != nil {
+		log.Fatalf("failed to list runs in catalog with %s", err.Error())
+	}
+	for _, info := range infos {
+		if info.ID == config.LoadConf.Cache.RunID {
+			return objects, info.Bytes
+		}
+	}
+	return objects, 0
+}
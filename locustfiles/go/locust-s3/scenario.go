@@ -0,0 +1,192 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/myzhan/boomer"
+)
+
+// scenarioRequestType reports steps of scenarios apart from independent operations
+const scenarioRequestType = "scenario"
+
+// errScenarioStopped tells ReleaseObject that the object of a scenario is not to be
+// added to or removed from the catalog
+var errScenarioStopped = errors.New("scenario stopped")
+
+// scenarioRun is one run of a scenario by a virtual user
+type scenarioRun struct {
+	scenario *config.Scenario
+	obj      objfactory.ObjectSpec
+	put      bool // the object is uploaded by the scenario, otherwise it is claimed from the catalog
+	exists   bool
+}
+
+// scenarioTasks returns a task of every configured scenario
+func scenarioTasks() []*boomer.Task {
+	var tasks []*boomer.Task
+	for i := range config.LoadConf.Ops.Scenarios {
+		sc := &config.LoadConf.Ops.Scenarios[i]
+		tasks = append(tasks, &boomer.Task{
+			Name:   "scenario-" + sc.Name,
+			Weight: sc.Weight,
+			Fn:     func() { runScenario(sc) },
+		})
+	}
+	return tasks
+}
+
+// runScenario runs steps of sc in order on one object, and stops at the first failed step.
+// every step is reported as <scenario>.<number>.<op>, and the whole flow, think time included,
+// as <scenario>.
+func runScenario(sc *config.Scenario) {
+	run := &scenarioRun{scenario: sc, put: sc.Steps[0].Op == config.StepPut}
+	if run.put {
+		if err := run.obj.GetObject(objfactory.Write); err != nil {
+			time.Sleep(1000 * time.Millisecond)
+			return
+		}
+		run.obj.ObjectData = throttleUpload(run.obj.ObjectData)
+	} else {
+		// claimed, so no one else deletes the object in the middle of the scenario
+		if err := run.obj.GetObject(objfactory.Delete); err != nil {
+			if config.Verbose {
+				fmt.Printf("no object for scenario %s from cache, will sleep 1sec and retry\n", sc.Name)
+			}
+			time.Sleep(1000 * time.Millisecond)
+			return
+		}
+		run.exists = true
+	}
+	defer run.finish()
+
+	flowStart := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	var length int64
+	for i, step := range sc.Steps {
+		name := fmt.Sprintf("%s.%d.%s", sc.Name, i+1, step.Op)
+		for j := 0; j < step.Repeat; j++ {
+			time.Sleep(step.Think)
+			start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+			n, sinkTime, err := run.step(step.Op)
+			elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+			switch {
+			case step.Op == config.StepGet:
+				// sink and content of a read are reported as those of an independent read
+				recordRead(scenarioRequestType, name, &run.obj, elapsed, sinkTime, n, err)
+			case err != nil:
+				boomer.RecordFailure(scenarioRequestType, name, elapsed,
+					fmt.Sprintf("%s/%s failed with %s", run.obj.ObjectBucket, run.obj.ObjectKey, err.Error()))
+			default:
+				boomer.RecordSuccess(scenarioRequestType, name, elapsed, n)
+				if config.Verbose {
+					fmt.Printf("%s object %s/%s\n", name, run.obj.ObjectBucket, run.obj.ObjectKey)
+				}
+			}
+			if err != nil {
+				flowElapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - flowStart
+				boomer.RecordFailure(scenarioRequestType, sc.Name, flowElapsed, name+" failed")
+				return
+			}
+			// checked out of the timing of the step, as independent operations are
+			switch step.Op {
+			case config.StepPut:
+				checkConsistency("putObject", &run.obj, true)
+			case config.StepDelete:
+				checkConsistency("deleteObject", &run.obj, false)
+			}
+			length += n
+		}
+	}
+	flowElapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - flowStart
+	boomer.RecordSuccess(scenarioRequestType, sc.Name, flowElapsed, length)
+}
+
+// step runs op on the object of the scenario, and returns number of bytes transferred and time
+// spent in the sink
+func (run *scenarioRun) step(op string) (int64, time.Duration, error) {
+	obj := &run.obj
+	switch op {
+	case config.StepPut:
+		// a repeated put uploads the body again from the start
+		if _, err := obj.ObjectData.Seek(0, io.SeekStart); err != nil {
+			return 0, 0, fmt.Errorf("failed to rewind body with %s", err.Error())
+		}
+		if err := writeObject(obj); err != nil {
+			return 0, 0, err
+		}
+		run.exists = true
+		return obj.ObjectSize, 0, nil
+	case config.StepHead:
+		input := &s3.HeadObjectInput{Bucket: aws.String(obj.ObjectBucket), Key: aws.String(obj.ObjectKey)}
+		input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(obj)
+		resp, err := sharedServiceClient.HeadObject(input)
+		if err != nil {
+			return 0, 0, err
+		}
+		return aws.Int64Value(resp.ContentLength), 0, nil
+	case config.StepGet:
+		input := &s3.GetObjectInput{Bucket: aws.String(obj.ObjectBucket), Key: aws.String(obj.ObjectKey)}
+		input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(obj)
+		resp, err := sharedServiceClient.GetObjectWithContext(context.Background(), input, withAcceptEncoding("identity"))
+		if err != nil {
+			return 0, 0, err
+		}
+		defer resp.Body.Close()
+		return readBody(obj, throttleDownload(resp.Body), 0, obj.ObjectSize)
+	case config.StepCopy:
+		var dst objfactory.ObjectSpec
+		dst.GetObject(objfactory.Copy)
+		err := sendCopyObject(obj, &dst)
+		dst.ReleaseObject(err)
+		return 0, 0, err
+	case config.StepDelete:
+		_, err := sharedServiceClient.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(obj.ObjectBucket),
+			Key:    aws.String(obj.ObjectKey)})
+		if err == nil {
+			run.exists = false
+		}
+		return 0, 0, err
+	default:
+		return 0, 0, fmt.Errorf("unsupported scenario op %s", op)
+	}
+}
+
+// finish adds an object put by the scenario to the catalog, or gives a claimed object back,
+// unless the object is gone
+func (run *scenarioRun) finish() {
+	switch {
+	case run.put && run.exists:
+		run.obj.ReleaseObject(nil)
+	case run.put:
+		run.obj.ReleaseObject(errScenarioStopped)
+	case run.exists:
+		run.obj.ReleaseObject(errScenarioStopped)
+	default:
+		run.obj.ReleaseObject(nil)
+	}
+}
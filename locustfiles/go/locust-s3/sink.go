@@ -0,0 +1,158 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+)
+
+// sinkRequestType reports time spent in the sink apart from time spent on the network
+const sinkRequestType = "sink"
+
+// sinkError is a failure of the sink, which is local to the runner and not a failure of the request
+type sinkError struct {
+	error
+}
+
+// sink consumes body of a downloaded object, to simulate what a client does with it
+type sink interface {
+	io.Writer
+	// Close finishes the object, e.g. syncs and removes the temp file
+	Close() error
+}
+
+// discardSink drops the body
+type discardSink struct{}
+
+func (discardSink) Write(p []byte) (int, error) { return len(p), nil }
+func (discardSink) Close() error                { return nil }
+
+// hashSink computes a checksum of the body, which costs CPU as a client verifying downloads does
+type hashSink struct {
+	hash.Hash
+}
+
+func (s hashSink) Close() error {
+	s.Sum(nil)
+	return nil
+}
+
+// fileSink writes the body to a temp file, which is removed when done
+type fileSink struct {
+	*os.File
+	fsync bool
+}
+
+func (s fileSink) Close() error {
+	defer os.Remove(s.Name())
+	if s.fsync {
+		if err := s.Sync(); err != nil {
+			s.File.Close()
+			return err
+		}
+	}
+	return s.File.Close()
+}
+
+// slowSink consumes at most rate bytes per second, like a slow consumer holding the
+// connection open
+type slowSink struct {
+	sink
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func (s *slowSink) Write(p []byte) (int, error) {
+	n, err := s.sink.Write(p)
+	s.written += int64(n)
+	due := s.start.Add(time.Duration(float64(s.written) / float64(s.rate) * float64(time.Second)))
+	time.Sleep(time.Until(due))
+	return n, err
+}
+
+// timedSink measures time spent in the sink, and tells its failures from failures of the body
+type timedSink struct {
+	sink
+	elapsed time.Duration
+}
+
+func (s *timedSink) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := s.sink.Write(p)
+	s.elapsed += time.Since(start)
+	if err != nil {
+		err = sinkError{err}
+	}
+	return n, err
+}
+
+func (s *timedSink) Close() error {
+	start := time.Now()
+	err := s.sink.Close()
+	s.elapsed += time.Since(start)
+	if err != nil {
+		err = sinkError{err}
+	}
+	return err
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newSink returns the configured sink of get_object
+func newSink() (*timedSink, error) {
+	conf := config.LoadConf.Ops.GetObject.Sink
+	var s sink
+	switch conf.Type {
+	case config.SinkHash:
+		switch conf.Hash {
+		case "sha256":
+			s = hashSink{sha256.New()}
+		case "crc32c":
+			s = hashSink{crc32.New(crc32cTable)}
+		default:
+			s = hashSink{md5.New()}
+		}
+	case config.SinkFile:
+		f, err := ioutil.TempFile(conf.Dir, "locust-s3-")
+		if err != nil {
+			return nil, sinkError{err}
+		}
+		s = fileSink{File: f, fsync: conf.Fsync}
+	default:
+		s = discardSink{}
+	}
+	if conf.Rate > 0 {
+		s = &slowSink{sink: s, rate: conf.Rate, start: time.Now()}
+	}
+	return &timedSink{sink: s}, nil
+}
+
+// sinkEnabled tells if time of the sink is worth reporting
+func sinkEnabled() bool {
+	conf := config.LoadConf.Ops.GetObject.Sink
+	return conf.Type != config.SinkDiscard || conf.Rate > 0
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/randstr"
+)
+
+// width of the longest bar of the size histogram
+const histogramWidth = 50
+
+// sampleSizes samples sizes of the configured distribution without uploading anything, and
+// prints a histogram of power of two bins with a few statistics
+func sampleSizes(args []string) {
+	fs := flag.NewFlagSet("sizes", flag.ExitOnError)
+	n := fs.Int("n", 100000, "number of sizes to sample")
+	fs.Parse(args)
+	if *n <= 0 {
+		log.Fatalf("invalid number of samples %d", *n)
+	}
+
+	r := randstr.New(randstr.Seed)
+	sizes := make([]int64, *n)
+	var total float64
+	// bin i holds sizes in [2^(i-1), 2^i), bin 0 holds empty objects
+	var bins [65]int
+	for i := range sizes {
+		size := objfactory.SampleSize(r)
+		sizes[i] = size
+		total += float64(size)
+		bins[bits.Len64(uint64(size))]++
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+
+	fmt.Printf("%d sizes of %s\n\n", *n, objfactory.SizeDistribution())
+	first, last := 0, len(bins)-1
+	for bins[first] == 0 {
+		first++
+	}
+	for bins[last] == 0 {
+		last--
+	}
+	most := 0
+	for _, count := range bins {
+		if count > most {
+			most = count
+		}
+	}
+	for i := first; i <= last; i++ {
+		label := "0"
+		if i > 0 {
+			label = fmt.Sprintf("%s - %s", formatSize(int64(1)<<uint(i-1)), formatSize(int64(1)<<uint(i)))
+		}
+		fmt.Printf("%-22s %10d %6.2f%% %s\n", label, bins[i], float64(bins[i])*100/float64(*n),
+			strings.Repeat("#", bins[i]*histogramWidth/most))
+	}
+
+	percentile := func(p float64) int64 { return sizes[int(p*float64(len(sizes)-1))] }
+	fmt.Printf("\nmean %s, min %s, p50 %s, p90 %s, p99 %s, max %s\n",
+		formatSize(int64(total/float64(*n))), formatSize(sizes[0]), formatSize(percentile(0.5)),
+		formatSize(percentile(0.9)), formatSize(percentile(0.99)), formatSize(sizes[len(sizes)-1]))
+}
+
+// formatSize prints a size with binary units
+func formatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
+}
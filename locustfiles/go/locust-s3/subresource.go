@@ -0,0 +1,283 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/randstr"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/myzhan/boomer"
+)
+
+// control plane operations on bucket and object sub-resources (policy, ACL and CORS).
+// the generated documents are valid but harmless: policies only deny deletes under
+// random prefixes, ACLs only grant the owner, and CORS rules allow random example origins.
+
+// error codes of a get on a sub-resource which has not been set. it is a served request, not a failure.
+var notConfiguredCodes = map[string]bool{
+	"NoSuchBucketPolicy":      true,
+	"NoSuchCORSConfiguration": true,
+}
+
+func randomBucket() string {
+	return config.LoadConf.Data.Buckets[rand.Intn(len(config.LoadConf.Data.Buckets))]
+}
+
+// recordSubresourceOp runs fn and reports it under name
+func recordSubresourceOp(name string, target string, fn func() error) error {
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	err := fn()
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	if aerr, ok := err.(awserr.Error); ok && notConfiguredCodes[aerr.Code()] {
+		err = nil
+	}
+	if err != nil {
+		boomer.RecordFailure("s3", name, elapsed, err.Error())
+	} else {
+		boomer.RecordSuccess("s3", name, elapsed, int64(10))
+		if config.Verbose {
+			fmt.Printf("%s on %s\n", name, target)
+		}
+	}
+	return err
+}
+
+type policyStatement struct {
+	Sid       string
+	Effect    string
+	Principal string
+	Action    []string
+	Resource  []string
+}
+
+type policyDocument struct {
+	Version   string
+	Statement []policyStatement
+}
+
+// newBucketPolicy generates a policy denying deletes under random prefixes of the bucket
+func newBucketPolicy(bucket string) string {
+	doc := policyDocument{Version: "2012-10-17"}
+	for i := 0; i < config.LoadConf.Ops.BucketPolicy.Statements; i++ {
+		doc.Statement = append(doc.Statement, policyStatement{
+			Sid:       fmt.Sprintf("locust%d", i),
+			Effect:    "Deny",
+			Principal: "*",
+			Action:    []string{"s3:DeleteObject"},
+			Resource: []string{fmt.Sprintf("arn:aws:s3:::%s/locust-denied-%s/*",
+				bucket, randstr.RandStringBytesMaskImprSrc(8))},
+		})
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		panic(err.Error())
+	}
+	return string(b)
+}
+
+var (
+	ownerOnce sync.Once
+	owner     *s3.Owner
+)
+
+// bucketOwner returns the owner of the buckets, which is the only grantee of generated ACLs
+func bucketOwner() *s3.Owner {
+	ownerOnce.Do(func() {
+		result, err := sharedServiceClient.ListBuckets(&s3.ListBucketsInput{})
+		if err != nil || result.Owner == nil || aws.StringValue(result.Owner.ID) == "" {
+			fmt.Println("could not find bucket owner, will use canned ACL")
+			return
+		}
+		owner = result.Owner
+	})
+	return owner
+}
+
+var aclPermissions = []string{s3.PermissionRead, s3.PermissionWrite, s3.PermissionReadAcp, s3.PermissionWriteAcp}
+
+// newAccessControlPolicy generates an ACL granting full control plus a random set of
+// permissions to the owner. it returns nil if owner is unknown.
+func newAccessControlPolicy() *s3.AccessControlPolicy {
+	o := bucketOwner()
+	if o == nil {
+		return nil
+	}
+	grant := func(permission string) *s3.Grant {
+		return &s3.Grant{
+			Grantee:    &s3.Grantee{ID: o.ID, Type: aws.String(s3.TypeCanonicalUser)},
+			Permission: aws.String(permission),
+		}
+	}
+	acp := &s3.AccessControlPolicy{Owner: o, Grants: []*s3.Grant{grant(s3.PermissionFullControl)}}
+	for _, p := range aclPermissions {
+		if rand.Intn(2) == 0 {
+			acp.Grants = append(acp.Grants, grant(p))
+		}
+	}
+	return acp
+}
+
+var corsMethods = []string{"GET", "PUT", "POST", "DELETE", "HEAD"}
+
+// newCORSConfiguration generates rules allowing random methods from random origins
+func newCORSConfiguration() *s3.CORSConfiguration {
+	var cors s3.CORSConfiguration
+	for i := 0; i < config.LoadConf.Ops.BucketCors.Rules; i++ {
+		methods := []string{corsMethods[0]}
+		for _, m := range corsMethods[1:] {
+			if rand.Intn(2) == 0 {
+				methods = append(methods, m)
+			}
+		}
+		cors.CORSRules = append(cors.CORSRules, &s3.CORSRule{
+			AllowedOrigins: aws.StringSlice([]string{
+				fmt.Sprintf("https://%s.example.com", strings.ToLower(randstr.RandStringBytesMaskImprSrc(12)))}),
+			AllowedMethods: aws.StringSlice(methods),
+			AllowedHeaders: aws.StringSlice([]string{"*"}),
+			ExposeHeaders:  aws.StringSlice([]string{"ETag"}),
+			MaxAgeSeconds:  aws.Int64(int64(rand.Intn(3600))),
+		})
+	}
+	return &cors
+}
+
+func putBucketPolicy() {
+	bucket := randomBucket()
+	policy := newBucketPolicy(bucket)
+	recordSubresourceOp("putBucketPolicy", bucket, func() error {
+		_, err := sharedServiceClient.PutBucketPolicy(&s3.PutBucketPolicyInput{
+			Bucket: aws.String(bucket),
+			Policy: aws.String(policy),
+		})
+		return err
+	})
+}
+
+func getBucketPolicy() {
+	bucket := randomBucket()
+	recordSubresourceOp("getBucketPolicy", bucket, func() error {
+		_, err := sharedServiceClient.GetBucketPolicy(&s3.GetBucketPolicyInput{Bucket: aws.String(bucket)})
+		return err
+	})
+}
+
+func deleteBucketPolicy() {
+	bucket := randomBucket()
+	recordSubresourceOp("deleteBucketPolicy", bucket, func() error {
+		_, err := sharedServiceClient.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{Bucket: aws.String(bucket)})
+		return err
+	})
+}
+
+func putBucketAcl() {
+	bucket := randomBucket()
+	input := &s3.PutBucketAclInput{Bucket: aws.String(bucket)}
+	if input.AccessControlPolicy = newAccessControlPolicy(); input.AccessControlPolicy == nil {
+		input.ACL = aws.String(s3.BucketCannedACLPrivate)
+	}
+	recordSubresourceOp("putBucketAcl", bucket, func() error {
+		_, err := sharedServiceClient.PutBucketAcl(input)
+		return err
+	})
+}
+
+func getBucketAcl() {
+	bucket := randomBucket()
+	recordSubresourceOp("getBucketAcl", bucket, func() error {
+		_, err := sharedServiceClient.GetBucketAcl(&s3.GetBucketAclInput{Bucket: aws.String(bucket)})
+		return err
+	})
+}
+
+func putObjectAcl() {
+	var obj objfactory.ObjectSpec
+	if err := obj.GetObject(objfactory.Modify); err != nil {
+		if config.Verbose {
+			fmt.Println("no object for put acl operation from cache, will sleep 1sec and retry")
+		}
+		time.Sleep(1000 * time.Millisecond)
+		return
+	}
+	input := &s3.PutObjectAclInput{Bucket: aws.String(obj.ObjectBucket), Key: aws.String(obj.ObjectKey)}
+	if input.AccessControlPolicy = newAccessControlPolicy(); input.AccessControlPolicy == nil {
+		input.ACL = aws.String(s3.ObjectCannedACLPrivate)
+	}
+	err := recordSubresourceOp("putObjectAcl", obj.ObjectBucket+"/"+obj.ObjectKey, func() error {
+		_, err := sharedServiceClient.PutObjectAcl(input)
+		return err
+	})
+	obj.ReleaseObject(err)
+}
+
+func getObjectAcl() {
+	var obj objfactory.ObjectSpec
+	if err := obj.GetObject(objfactory.Read); err != nil {
+		if config.Verbose {
+			fmt.Println("no object for get acl operation from cache, will sleep 1sec and retry")
+		}
+		time.Sleep(1000 * time.Millisecond)
+		return
+	}
+	err := recordSubresourceOp("getObjectAcl", obj.ObjectBucket+"/"+obj.ObjectKey, func() error {
+		_, err := sharedServiceClient.GetObjectAcl(&s3.GetObjectAclInput{
+			Bucket: aws.String(obj.ObjectBucket),
+			Key:    aws.String(obj.ObjectKey),
+		})
+		return err
+	})
+	obj.ReleaseObject(err)
+}
+
+func putBucketCors() {
+	bucket := randomBucket()
+	cors := newCORSConfiguration()
+	recordSubresourceOp("putBucketCors", bucket, func() error {
+		_, err := sharedServiceClient.PutBucketCors(&s3.PutBucketCorsInput{
+			Bucket:            aws.String(bucket),
+			CORSConfiguration: cors,
+		})
+		return err
+	})
+}
+
+func getBucketCors() {
+	bucket := randomBucket()
+	recordSubresourceOp("getBucketCors", bucket, func() error {
+		_, err := sharedServiceClient.GetBucketCors(&s3.GetBucketCorsInput{Bucket: aws.String(bucket)})
+		return err
+	})
+}
+
+func deleteBucketCors() {
+	bucket := randomBucket()
+	recordSubresourceOp("deleteBucketCors", bucket, func() error {
+		_, err := sharedServiceClient.DeleteBucketCors(&s3.DeleteBucketCorsInput{Bucket: aws.String(bucket)})
+		return err
+	})
+}
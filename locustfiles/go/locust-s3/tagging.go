@@ -0,0 +1,133 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/objfactory"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/myzhan/boomer"
+)
+
+// encodeTagging encodes tags as the URL query string expected by x-amz-tagging
+func encodeTagging(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	v := url.Values{}
+	for k, t := range tags {
+		v.Set(k, t)
+	}
+	return aws.String(v.Encode())
+}
+
+func putObjectTagging() {
+	var obj objfactory.ObjectSpec
+	if err := obj.GetObject(objfactory.Modify); err != nil {
+		if config.Verbose {
+			fmt.Println("no object for put tagging operation from cache, will sleep 1sec and retry")
+		}
+		time.Sleep(1000 * time.Millisecond)
+		return
+	}
+
+	tags := objfactory.GenerateTags(config.LoadConf.Ops.ObjectTagging.Count, config.LoadConf.Ops.ObjectTagging.Size)
+	tagSet := make([]*s3.Tag, 0, len(tags))
+	for k, v := range tags {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	_, err := sharedServiceClient.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  aws.String(obj.ObjectBucket),
+		Key:     aws.String(obj.ObjectKey),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	if err != nil {
+		boomer.RecordFailure("s3", "putObjectTagging", elapsed, err.Error())
+	} else {
+		boomer.RecordSuccess("s3", "putObjectTagging", elapsed, int64(10))
+		if config.Verbose {
+			fmt.Printf("put %d tags on object %s/%s\n", len(tagSet), obj.ObjectBucket, obj.ObjectKey)
+		}
+	}
+	obj.ReleaseObject(err)
+}
+
+func getObjectTagging() {
+	var obj objfactory.ObjectSpec
+	if err := obj.GetObject(objfactory.Read); err != nil {
+		if config.Verbose {
+			fmt.Println("no object for get tagging operation from cache, will sleep 1sec and retry")
+		}
+		time.Sleep(1000 * time.Millisecond)
+		return
+	}
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	resp, err := sharedServiceClient.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(obj.ObjectBucket),
+		Key:    aws.String(obj.ObjectKey),
+	})
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	if err != nil {
+		boomer.RecordFailure("s3", "getObjectTagging", elapsed, err.Error())
+	} else {
+		boomer.RecordSuccess("s3", "getObjectTagging", elapsed, int64(len(resp.TagSet)))
+		if config.Verbose {
+			fmt.Printf("get %d tags of object %s/%s\n", len(resp.TagSet), obj.ObjectBucket, obj.ObjectKey)
+		}
+	}
+	obj.ReleaseObject(err)
+}
+
+func deleteObjectTagging() {
+	var obj objfactory.ObjectSpec
+	if err := obj.GetObject(objfactory.Modify); err != nil {
+		if config.Verbose {
+			fmt.Println("no object for delete tagging operation from cache, will sleep 1sec and retry")
+		}
+		time.Sleep(1000 * time.Millisecond)
+		return
+	}
+
+	start := time.Now().UnixNano() / config.LoadConf.Locust.TimeResolution
+	_, err := sharedServiceClient.DeleteObjectTagging(&s3.DeleteObjectTaggingInput{
+		Bucket: aws.String(obj.ObjectBucket),
+		Key:    aws.String(obj.ObjectKey),
+	})
+	elapsed := time.Now().UnixNano()/config.LoadConf.Locust.TimeResolution - start
+
+	if err != nil {
+		boomer.RecordFailure("s3", "deleteObjectTagging", elapsed, err.Error())
+	} else {
+		boomer.RecordSuccess("s3", "deleteObjectTagging", elapsed, int64(10))
+		if config.Verbose {
+			fmt.Printf("delete tags of object %s/%s\n", obj.ObjectBucket, obj.ObjectKey)
+		}
+	}
+	obj.ReleaseObject(err)
+}
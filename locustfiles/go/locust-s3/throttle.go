@@ -0,0 +1,140 @@
+/*
+Copyright 2019 TWO SIGMA OPEN SOURCE, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/twosigma/locust-s3/locustfiles/go/locust-s3/internal/config"
+)
+
+// throttled readers read at most this many bytes at a time, so bandwidth is smooth
+const throttleChunk = 16 << 10
+
+// tokenBucket limits bandwidth to rate bytes per second, with bursts of up to throttleChunk
+// bytes. tokens go negative when more is taken than there is, which delays later takers.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: throttleChunk, last: time.Now()}
+}
+
+// take removes n tokens, and returns how long to wait until they are paid off
+func (b *tokenBucket) take(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > throttleChunk {
+		b.tokens = throttleChunk
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttledReader reads no faster than both the bucket of its request and the global one
+type throttledReader struct {
+	io.Reader
+	request *tokenBucket
+	global  *tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.Reader.Read(p)
+	wait := t.request.take(n)
+	if w := t.global.take(n); w > wait {
+		wait = w
+	}
+	time.Sleep(wait)
+	return n, err
+}
+
+// throttledReadSeeker is a throttled upload body. seek is not throttled, and close goes to
+// the body if it could be closed.
+type throttledReadSeeker struct {
+	throttledReader
+	body io.ReadSeeker
+}
+
+func (t *throttledReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return t.body.Seek(offset, whence)
+}
+
+func (t *throttledReadSeeker) Close() error {
+	if c, ok := t.body.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// global buckets are shared by all virtual users of this runner
+var uploadBucket, downloadBucket *tokenBucket
+
+func init() {
+	throttle := config.LoadConf.Ops.Throttle
+	uploadBucket = newTokenBucket(throttle.Upload.Global)
+	downloadBucket = newTokenBucket(throttle.Download.Global)
+}
+
+// throttleUpload limits bandwidth of an upload body
+func throttleUpload(body io.ReadSeeker) io.ReadSeeker {
+	perRequest := config.LoadConf.Ops.Throttle.Upload.PerRequest
+	if perRequest <= 0 && uploadBucket == nil {
+		return body
+	}
+	return &throttledReadSeeker{
+		throttledReader: throttledReader{Reader: body, request: newTokenBucket(perRequest), global: uploadBucket},
+		body:            body,
+	}
+}
+
+// unthrottled returns the body of a throttled upload, to read it on the side, e.g. for checksum
+func unthrottled(body io.ReadSeeker) io.ReadSeeker {
+	if t, ok := body.(*throttledReadSeeker); ok {
+		return t.body
+	}
+	return body
+}
+
+// throttleDownload limits bandwidth of a download body
+func throttleDownload(body io.Reader) io.Reader {
+	perRequest := config.LoadConf.Ops.Throttle.Download.PerRequest
+	if perRequest <= 0 && downloadBucket == nil {
+		return body
+	}
+	return &throttledReader{Reader: body, request: newTokenBucket(perRequest), global: downloadBucket}
+}